@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-ini/ini"
+	"gopkg.in/yaml.v3"
+)
+
+// Configurations are either .ini files or .yaml/.yml files. YAML configs are translated to
+// the sections of the .ini format, so both are loaded and validated the same way:
+//
+//	zones:
+//	  eu-1: [10.0.1.1:9001, 10.0.1.2:9001]
+//	services:
+//	  bank:
+//	    listen: :9001
+//	    backends: [10.0.1.1:9001, 10.0.2.1:9001]
+//	    timeout: 2s              # Any key of [service.bank]
+//	    routes:
+//	      reads: {path: /account, method: GET, backends: [10.0.1.1:9001]}
+//	    versions:
+//	      canary: {backends: [10.0.3.1:9001], weight: 5}
+//	    tcp:
+//	      shop: {listen: 127.0.0.1:16379, max_connections: 50}
+//
+// Lists can be written as YAML sequences, header and threshold lists also as mappings.
+type config struct {
+	*ini.File
+
+	// Line numbers of sections (key: section name) and keys (key: section + "/" + key name)
+	lines map[string]int
+}
+
+func loadConfig(filename string) (*config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return loadYamlConfig(data)
+	default:
+		file, err := ini.Load(data)
+		if err != nil {
+			return nil, err
+		}
+		return &config{File: file, lines: iniLines(data)}, nil
+	}
+}
+
+func (conf *config) line(section string, key string) int {
+	if key != "" {
+		if line, ok := conf.lines[section+"/"+key]; ok {
+			return line
+		}
+	}
+	return conf.lines[section]
+}
+
+// Locate sections and keys in the .ini file, which go-ini does not report
+func iniLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	section := ini.DEFAULT_SECTION
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			section = strings.TrimSpace(strings.Trim(line, "[]"))
+			lines[section] = i + 1
+		default:
+			if index := strings.IndexAny(line, "=:"); index > 0 {
+				lines[section+"/"+strings.TrimSpace(line[:index])] = i + 1
+			}
+		}
+	}
+	return lines
+}
+
+type yamlConverter struct {
+	conf   *config
+	errors configErrors
+}
+
+func loadYamlConfig(data []byte) (*config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	converter := &yamlConverter{
+		conf: &config{File: ini.Empty(), lines: make(map[string]int)},
+	}
+	if len(root.Content) > 0 {
+		converter.convert(root.Content[0])
+	}
+	if len(converter.errors) > 0 {
+		return nil, converter.errors
+	}
+	return converter.conf, nil
+}
+
+func (c *yamlConverter) errorf(node *yaml.Node, format string, args ...interface{}) {
+	c.errors = append(c.errors, &configError{Line: node.Line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Call handle for every key of the mapping node
+func (c *yamlConverter) mapping(node *yaml.Node, handle func(key, value *yaml.Node)) {
+	if node.Kind != yaml.MappingNode {
+		c.errorf(node, "Expected a mapping")
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		handle(node.Content[i], node.Content[i+1])
+	}
+}
+
+func (c *yamlConverter) section(name string, node *yaml.Node) *ini.Section {
+	section, err := c.conf.NewSection(name)
+	if err != nil {
+		c.errorf(node, "%v", err)
+		return nil
+	}
+	if _, ok := c.conf.lines[name]; !ok {
+		c.conf.lines[name] = node.Line
+	}
+	return section
+}
+
+func (c *yamlConverter) set(sectionName string, key, value *yaml.Node) {
+	section := c.section(sectionName, key)
+	str, ok := c.value(value)
+	if section == nil || !ok {
+		return
+	}
+	if section.HasKey(key.Value) {
+		c.errorf(key, "Duplicate key %v", key.Value)
+		return
+	}
+	if _, err := section.NewKey(key.Value, str); err != nil {
+		c.errorf(key, "%v", err)
+		return
+	}
+	c.conf.lines[sectionName+"/"+key.Value] = key.Line
+}
+
+// Convert scalars, sequences of scalars and mappings of scalars to .ini values
+func (c *yamlConverter) value(node *yaml.Node) (string, bool) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value, true
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				c.errorf(item, "Expected a list of values")
+				return "", false
+			}
+			values = append(values, item.Value)
+		}
+		return strings.Join(values, ", "), true
+	case yaml.MappingNode:
+		values := make([]string, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Kind != yaml.ScalarNode {
+				c.errorf(node.Content[i+1], "Expected a value")
+				return "", false
+			}
+			values = append(values, node.Content[i].Value+": "+node.Content[i+1].Value)
+		}
+		return strings.Join(values, ", "), true
+	default:
+		c.errorf(node, "Unsupported value")
+		return "", false
+	}
+}
+
+func (c *yamlConverter) convert(root *yaml.Node) {
+	c.mapping(root, func(key, value *yaml.Node) {
+		switch key.Value {
+		case "zones":
+			c.mapping(value, func(zone, hosts *yaml.Node) {
+				c.set("zones", zone, hosts)
+			})
+		case "services":
+			c.mapping(value, func(service, settings *yaml.Node) {
+				c.convertService(service.Value, settings)
+			})
+		default:
+			c.errorf(key, "Unknown setting %v", key.Value)
+		}
+	})
+}
+
+func (c *yamlConverter) convertService(service string, node *yaml.Node) {
+	c.mapping(node, func(key, value *yaml.Node) {
+		switch key.Value {
+		case "listen":
+			c.set("services", &yaml.Node{Value: service, Line: key.Line}, value)
+		case "backends":
+			c.set("backends", &yaml.Node{Value: service, Line: key.Line}, value)
+		case "routes":
+			c.convertSubsections(route_section_prefix+service+".", value)
+		case "versions":
+			c.convertSubsections(version_section_prefix+service+".", value)
+		case "tcp":
+			c.mapping(value, func(client, settings *yaml.Node) {
+				c.convertTcpClient(tcp_section_prefix+service, client, settings)
+			})
+		default:
+			c.set(service_section_prefix+service, key, value)
+		}
+	})
+}
+
+func (c *yamlConverter) convertSubsections(prefix string, node *yaml.Node) {
+	c.mapping(node, func(name, settings *yaml.Node) {
+		section := prefix + name.Value
+		c.section(section, name)
+		c.mapping(settings, func(key, value *yaml.Node) {
+			c.set(section, key, value)
+		})
+	})
+}
+
+func (c *yamlConverter) convertTcpClient(section string, client, node *yaml.Node) {
+	var listen, maxConns string
+	c.mapping(node, func(key, value *yaml.Node) {
+		switch key.Value {
+		case "listen":
+			listen = value.Value
+		case "max_connections":
+			maxConns = value.Value
+		default:
+			c.errorf(key, "Unknown setting %v", key.Value)
+		}
+	})
+	if maxConns != "" {
+		listen += ", " + maxConns
+	}
+	c.set(section, client, &yaml.Node{Kind: yaml.ScalarNode, Value: listen, Line: client.Line})
+}
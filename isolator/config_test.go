@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Load the configuration from a file with the given extension
+func parseConfig(t *testing.T, ext string, text string) (*config, error) {
+	filename := filepath.Join(t.TempDir(), "isolator"+ext)
+	if err := ioutil.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(filename)
+}
+
+const yamlExample = `
+zones:
+  eu-1: [10.0.1.1:9001, 10.0.1.2:9001]
+services:
+  bank:
+    listen: :9001
+    backends: [10.0.1.1:9001, 10.0.2.1:9001]
+    timeout: 2s
+    add_request_headers: {X-Env: test, X-Team: ops}
+    routes:
+      reads: {path: /account, method: GET, backends: [10.0.1.1:9001]}
+    versions:
+      canary: {backends: [10.0.3.1:9001], weight: 5}
+    tcp:
+      shop: {listen: 127.0.0.1:16379, max_connections: 50}
+      catalog: {listen: 127.0.0.1:16380}
+`
+
+func TestYamlConversion(t *testing.T) {
+	conf, err := parseConfig(t, ".yaml", yamlExample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		section, key, value string
+		line                int
+	}{
+		{"zones", "eu-1", "10.0.1.1:9001, 10.0.1.2:9001", 3},
+		{"services", "bank", ":9001", 6},
+		{"backends", "bank", "10.0.1.1:9001, 10.0.2.1:9001", 7},
+		{"service.bank", "timeout", "2s", 8},
+		{"service.bank", "add_request_headers", "X-Env: test, X-Team: ops", 9},
+		{"route.bank.reads", "path", "/account", 11},
+		{"route.bank.reads", "backends", "10.0.1.1:9001", 11},
+		{"version.bank.canary", "weight", "5", 13},
+		{"tcp.bank", "shop", "127.0.0.1:16379, 50", 15},
+		{"tcp.bank", "catalog", "127.0.0.1:16380", 16},
+	} {
+		if value := conf.Section(test.section).Key(test.key).String(); value != test.value {
+			t.Errorf("[%v] %v = %q, expected %q", test.section, test.key, value, test.value)
+		}
+		if line := conf.line(test.section, test.key); line != test.line {
+			t.Errorf("[%v] %v on line %v, expected %v", test.section, test.key, line, test.line)
+		}
+	}
+	if err := validateConfig(conf); err != nil {
+		t.Errorf("Converted configuration is invalid:\n%v", err)
+	}
+}
+
+func TestYamlConversionErrors(t *testing.T) {
+	for _, test := range []struct {
+		name, yaml string
+		errors     []string
+	}{
+		{"unknown setting", "services: {}\nzone: {}", []string{"line 2: Unknown setting zone"}},
+		{"services not a mapping", "services: [bank]", []string{"line 1: Expected a mapping"}},
+		{"nested list", "services:\n  bank:\n    backends: [[10.0.1.1:9001]]", []string{"line 3: Expected a list of values"}},
+		{"nested mapping", "services:\n  bank:\n    add_request_headers: {X-Env: [a]}", []string{"line 3: Expected a value"}},
+		{"unknown tcp setting", "services:\n  bank:\n    tcp:\n      shop: {port: 1}", []string{"line 4: Unknown setting port"}},
+		{"multiple errors", "services:\n  bank: []\nzones: 1\nother: 2", []string{
+			"line 2: Expected a mapping", "line 3: Expected a mapping", "line 4: Unknown setting other"}},
+		{"syntax error", "services: [", []string{"yaml: line 1: did not find expected node content"}},
+	} {
+		_, err := parseConfig(t, ".yml", test.yaml)
+		if err == nil {
+			t.Errorf("%v: no error", test.name)
+			continue
+		}
+		if errors := strings.Split(err.Error(), "\n"); strings.Join(errors, "|") != strings.Join(test.errors, "|") {
+			t.Errorf("%v: errors %q, expected %q", test.name, errors, test.errors)
+		}
+	}
+}
+
+func TestValidateConfigAcceptsServiceWithoutBackends(t *testing.T) {
+	conf, err := parseConfig(t, ".ini", "[services]\nbank = :9001\nshop = :9004\n[backends]\nbank = 10.0.1.1:9001\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(conf); err != nil {
+		t.Errorf("Service without backends rejected:\n%v", err)
+	}
+}
+
+func TestValidateConfigLines(t *testing.T) {
+	for _, test := range []struct {
+		name, ext, text string
+		errors          []string // Prefixes of the reported errors
+	}{
+		{"ini", ".ini", `
+[services]
+bank = :9001
+shop = :9004
+[backends]
+bank = 10.0.1.1:9001
+
+[service.bank]
+timeout = soon
+colour = blue
+[route.bank.reads]
+path = /account
+[version.bank.canary]
+backends = 10.0.3.1:9001
+weight = 0
+[tcp.shop]
+bank = 127.0.0.1:16379
+`, []string{
+			"line 9: Illegal value for timeout in [service.bank]: time: invalid duration",
+			"line 10: Unknown setting colour in [service.bank]",
+			"line 11: Route [route.bank.reads] has no backends",
+			"line 15: Illegal value for weight in [version.bank.canary]: Expected a positive number, got 0",
+			"line 16: Service shop has no backends",
+		}},
+		{"ini without sections", ".ini", "timeout = 2s\n", []string{
+			"Missing section [backends]",
+			"Missing section [services]",
+			"line 1: Setting timeout outside of any section",
+		}},
+		{"yaml", ".yaml", `services:
+  bank:
+    listen: :9001
+    backends: [10.0.1.1:9001, localhost]
+    timeout: soon
+    routes:
+      reads: {method: GET}
+    versions:
+      canary: {weight: -1}
+`, []string{
+			"line 4: Illegal value for bank in [backends]: address localhost: missing port in address",
+			"line 5: Illegal value for timeout in [service.bank]: time: invalid duration",
+			"line 7: Route [route.bank.reads] has no backends",
+			"line 9: Illegal value for weight in [version.bank.canary]",
+		}},
+	} {
+		conf, err := parseConfig(t, test.ext, test.text)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		err = validateConfig(conf)
+		if err == nil {
+			t.Errorf("%v: no validation errors", test.name)
+			continue
+		}
+		errors := strings.Split(err.Error(), "\n")
+		if len(errors) != len(test.errors) {
+			t.Errorf("%v: errors %q, expected %q", test.name, errors, test.errors)
+			continue
+		}
+		for i, expected := range test.errors {
+			if !strings.HasPrefix(errors[i], expected) {
+				t.Errorf("%v: error %q, expected %q", test.name, errors[i], expected)
+			}
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/antongulenko/golib"
@@ -15,9 +17,27 @@ import (
 )
 
 const (
-	stats_path   = "/stats"
-	runtime_path = "/runtime"
-	open_files   = 40000
+	stats_path     = "/stats"
+	runtime_path   = "/runtime"
+	events_path    = "/events"
+	dashboard_path = "/dashboard"
+	cluster_path   = "/cluster"
+	loglevel_path  = "/loglevel"
+	canary_path    = "/canary"
+	open_files     = 40000
+
+	// Sections like [service.bank] contain optional settings for one service
+	service_section_prefix = "service."
+
+	// Sections like [route.bank.reads] define routing rules for one service
+	route_section_prefix = "route."
+
+	// Sections like [version.shop.canary] assign a version label and weight to backends
+	version_section_prefix = "version."
+
+	// Sections like [tcp.redis] map client services to listen addresses and connection limits
+	// for a non-HTTP service: bank = 127.0.0.1:16379, 50
+	tcp_section_prefix = "tcp."
 )
 
 func check(err error) {
@@ -26,16 +46,51 @@ func check(err error) {
 	}
 }
 
+// Maps backend addresses to the zones configured in the optional [zones] section
+var endpointZones = make(map[string]string)
+
+func loadZones(confIni *ini.File) {
+	zones, err := confIni.GetSection("zones")
+	if err != nil {
+		return // No zones configured
+	}
+	for _, zone := range zones.Keys() {
+		for _, addr := range zone.Strings(",") {
+			endpointZones[addr] = zone.Name()
+		}
+	}
+}
+
+// Endpoint options configured in the [service.<name>] sections
+var endpointOptions = make(map[string][]proxy.EndpointOption)
+
+func loadEndpointOptions(confIni *ini.File) {
+	for _, section := range confIni.Sections() {
+		if strings.HasPrefix(section.Name(), service_section_prefix) {
+			service := strings.TrimPrefix(section.Name(), service_section_prefix)
+			options := []proxy.EndpointOption{
+				proxy.WithCheckInterval(section.Key("health_check_interval").MustDuration(0)),
+			}
+			if window := section.Key("slow_start").MustDuration(0); window > 0 {
+				mode, err := proxy.ParseSlowStartMode(section.Key("slow_start_mode").String())
+				check(err)
+				options = append(options, proxy.WithSlowStart(window, mode))
+			}
+			endpointOptions[service] = options
+		}
+	}
+}
+
+func newEndpoint(service, addr string) *proxy.Endpoint {
+	options := append([]proxy.EndpointOption{proxy.WithEndpointZone(endpointZones[addr])}, endpointOptions[service]...)
+	return proxy.NewEndpoint(service, addr, options...)
+}
+
 func loadServiceRegistry(confIni *ini.File) proxy.LocalRegistry {
 	reg := make(proxy.LocalRegistry)
 	addService := func(name string, endpoints ...string) {
 		for _, addr := range endpoints {
-			endpoint := &proxy.Endpoint{
-				Service: name,
-				Host:    addr,
-			}
-			endpoint.TestActive()
-			reg.Add(name, endpoint)
+			reg.Add(name, newEndpoint(name, addr))
 		}
 	}
 
@@ -44,9 +99,251 @@ func loadServiceRegistry(confIni *ini.File) proxy.LocalRegistry {
 	for _, service := range confSection.Keys() {
 		addService(service.Name(), service.Strings(",")...)
 	}
+
+	// Version sections label existing backends or add new ones
+	for _, section := range confIni.Sections() {
+		if !strings.HasPrefix(section.Name(), version_section_prefix) {
+			continue
+		}
+		service, version := splitSectionName(section.Name(), version_section_prefix)
+		weight := uint(section.Key("weight").MustUint(1))
+		for _, addr := range section.Key("backends").Strings(",") {
+			endpoint := reg.Find(service, addr)
+			if endpoint == nil {
+				endpoint = newEndpoint(service, addr)
+				reg.Add(service, endpoint)
+			}
+			endpoint.Version = version
+			endpoint.Weight = weight
+		}
+	}
 	return reg
 }
 
+func loadServiceConfigs(confIni *ini.File, p *proxy.IsolationProxy) {
+	for _, section := range confIni.Sections() {
+		switch name := section.Name(); {
+		case strings.HasPrefix(name, service_section_prefix):
+			loadServiceConfig(strings.TrimPrefix(name, service_section_prefix), section, p)
+		case strings.HasPrefix(name, route_section_prefix):
+			service, route := splitSectionName(name, route_section_prefix)
+			loadRoute(service, route, section, p)
+		case strings.HasPrefix(name, version_section_prefix):
+			service, _ := splitSectionName(name, version_section_prefix)
+			ensureSplit(p.Configure(service))
+		}
+	}
+}
+
+// Split [<prefix><service>.<name>] into service and name
+func splitSectionName(section, prefix string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(section, prefix), ".", 2)
+	if len(parts) != 2 {
+		log.Fatalf("Illegal section [%v], expected [%v<service>.<name>]\n", section, prefix)
+	}
+	return parts[0], parts[1]
+}
+
+func ensureSplit(config *proxy.ServiceConfig) *proxy.VersionSplit {
+	if config.Split == nil {
+		config.Split = new(proxy.VersionSplit)
+	}
+	return config.Split
+}
+
+func loadServiceConfig(service string, section *ini.Section, p *proxy.IsolationProxy) {
+	config := p.Configure(service)
+	if shadowHosts := section.Key("shadow").Strings(","); len(shadowHosts) > 0 {
+		shadow := &proxy.Shadow{
+			Percent:       section.Key("shadow_percent").MustFloat64(100),
+			Timeout:       section.Key("shadow_timeout").MustDuration(0),
+			MaxConcurrent: section.Key("shadow_max_concurrent").MustInt(0),
+			MaxBodySize:   section.Key("shadow_max_body_size").MustInt64(0),
+		}
+		for _, addr := range shadowHosts {
+			// Mirrored requests do not change the state of shadow endpoints, no need to check them
+			shadow.Endpoints = append(shadow.Endpoints, &proxy.Endpoint{Service: service + " shadow", Host: addr})
+		}
+		config.Shadow = shadow
+	}
+	hash := &proxy.ConsistentHash{
+		Header:     section.Key("hash_header").String(),
+		Cookie:     section.Key("hash_cookie").String(),
+		Path:       section.Key("hash_path").String(),
+		FormKey:    section.Key("hash_form").String(),
+		LoadFactor: section.Key("hash_load_factor").MustFloat64(0),
+	}
+	if hash.Header != "" || hash.Cookie != "" || hash.Path != "" || hash.FormKey != "" {
+		config.Hash = hash
+	}
+	config.Timeout = section.Key("timeout").MustDuration(0)
+	config.FlushInterval = section.Key("flush_interval").MustDuration(0)
+	sanitizer := &proxy.Sanitizer{
+		MaxBodySize:           section.Key("max_body_size").MustInt64(0),
+		MaxHeaderSize:         section.Key("max_header_size").MustInt(0),
+		RemoveRequestHeaders:  section.Key("remove_request_headers").Strings(","),
+		AddRequestHeaders:     parseHeaders(section.Key("add_request_headers").Strings(",")),
+		RemoveResponseHeaders: section.Key("remove_response_headers").Strings(","),
+		AddResponseHeaders:    parseHeaders(section.Key("add_response_headers").Strings(",")),
+		AddServiceHeader:      section.Key("service_header").MustBool(false),
+	}
+	if sanitizer.MaxBodySize > 0 || sanitizer.MaxHeaderSize > 0 || sanitizer.AddServiceHeader ||
+		len(sanitizer.RemoveRequestHeaders) > 0 || len(sanitizer.AddRequestHeaders) > 0 ||
+		len(sanitizer.RemoveResponseHeaders) > 0 || len(sanitizer.AddResponseHeaders) > 0 {
+		config.Sanitizer = sanitizer
+	}
+	if policy := section.Key("locality").String(); policy != "" {
+		localityPolicy, err := proxy.ParseLocalityPolicy(policy)
+		check(err)
+		config.Locality = &proxy.Locality{
+			Policy:  localityPolicy,
+			MaxLoad: section.Key("locality_max_load").MustInt(0),
+		}
+	}
+	if cookie := section.Key("sticky_cookie").String(); cookie != "" {
+		ensureSplit(config).Cookie = cookie
+	}
+	if formKey := section.Key("sticky_form").String(); formKey != "" {
+		ensureSplit(config).FormKey = formKey
+	}
+	if canary := section.Key("canary").String(); canary != "" {
+		split := ensureSplit(config)
+		split.Canary = canary
+		split.Baseline = section.Key("canary_baseline").String()
+		split.MaxErrorRateDiff = section.Key("canary_max_error_diff").MustFloat64(0.05)
+		split.MinRequests = uint(section.Key("canary_min_requests").MustUint(0))
+		split.Window = section.Key("canary_window").MustDuration(0)
+	}
+	if maxLoad := section.Key("max_load").MustInt(0); maxLoad > 0 {
+		config.Shedder = &proxy.LoadShedder{
+			MaxLoad:    maxLoad,
+			Thresholds: parseShedThresholds(section.Key("shed_thresholds").Strings(",")),
+		}
+	}
+	if order := section.Key("queue").String(); order != "" {
+		queueOrder, err := proxy.ParseQueueOrder(order)
+		check(err)
+		config.Queue = &proxy.RequestQueue{
+			Order:   queueOrder,
+			MaxWait: section.Key("queue_max_wait").MustDuration(0),
+			MaxSize: section.Key("queue_max_size").MustInt(0),
+			MaxLoad: section.Key("queue_max_load").MustInt(0),
+		}
+	}
+}
+
+// Parse a list of "criticality: fraction" entries, e.g. "sheddable: 0.4, normal: 0.7"
+func parseShedThresholds(entries []string) map[proxy.Criticality]float64 {
+	thresholds := make(map[proxy.Criticality]float64)
+	for _, entry := range entries {
+		key, value := splitCondition(entry, ":")
+		criticality, err := proxy.ParseCriticality(key)
+		check(err)
+		threshold, err := strconv.ParseFloat(value, 64)
+		check(err)
+		thresholds[criticality] = threshold
+	}
+	return thresholds
+}
+
+func loadRoute(service, name string, section *ini.Section, p *proxy.IsolationProxy) {
+	route := &proxy.Route{
+		Name:    name,
+		Path:    section.Key("path").String(),
+		Methods: section.Key("method").Strings(","),
+	}
+	if header := section.Key("header").String(); header != "" {
+		route.Header, route.HeaderValue = splitCondition(header, ":")
+	}
+	if form := section.Key("form").String(); form != "" {
+		route.FormKey, route.FormValue = splitCondition(form, "=")
+	}
+	if criticality := section.Key("criticality").String(); criticality != "" {
+		var err error
+		route.Criticality, err = proxy.ParseCriticality(criticality)
+		check(err)
+	}
+	backends := section.Key("backends").Strings(",")
+	if len(backends) == 0 {
+		log.Fatalf("Route %v of service %v has no backends\n", name, service)
+	}
+	for _, addr := range backends {
+		route.Endpoints = append(route.Endpoints, findEndpoint(p.Registry, service, addr))
+	}
+	config := p.Configure(service)
+	config.Routes = append(config.Routes, route)
+}
+
+// Split "key<sep>value" into key and value, the value is optional
+func splitCondition(condition, sep string) (string, string) {
+	parts := strings.SplitN(condition, sep, 2)
+	key := strings.TrimSpace(parts[0])
+	if len(parts) == 1 {
+		return key, ""
+	}
+	return key, strings.TrimSpace(parts[1])
+}
+
+// Parse a list of "Name: value" entries
+func parseHeaders(entries []string) http.Header {
+	header := make(http.Header)
+	for _, entry := range entries {
+		key, value := splitCondition(entry, ":")
+		header.Add(key, value)
+	}
+	return header
+}
+
+// Endpoints only used in [route.*] sections, by service and address. The proxy includes
+// them in the statistics of their service.
+var routeEndpoints = make(map[string]map[string]*proxy.Endpoint)
+
+// Share the endpoint (and its state) with the [backends] section or other routes, if possible
+func findEndpoint(reg proxy.Registry, service, addr string) *proxy.Endpoint {
+	if endpoints, err := reg.Endpoints(service); err == nil {
+		for _, endpoint := range endpoints {
+			if endpoint.Host == addr {
+				return endpoint
+			}
+		}
+	}
+	if routeEndpoints[service] == nil {
+		routeEndpoints[service] = make(map[string]*proxy.Endpoint)
+	}
+	endpoint := routeEndpoints[service][addr]
+	if endpoint == nil {
+		endpoint = newEndpoint(service, addr)
+		routeEndpoints[service][addr] = endpoint
+	}
+	return endpoint
+}
+
+func handleTcpServices(confIni *ini.File, p *proxy.IsolationProxy) {
+	for _, section := range confIni.Sections() {
+		if !strings.HasPrefix(section.Name(), tcp_section_prefix) {
+			continue
+		}
+		service := strings.TrimPrefix(section.Name(), tcp_section_prefix)
+		config := p.Configure(service)
+		for _, key := range section.Keys() {
+			values := key.Strings(",")
+			client := &proxy.TcpClient{
+				Name:   key.Name(),
+				Listen: values[0],
+			}
+			if len(values) > 1 {
+				maxConns, err := strconv.Atoi(values[1])
+				check(err)
+				client.MaxConnections = maxConns
+			}
+			config.TcpClients = append(config.TcpClients, client)
+			go func(client *proxy.TcpClient) {
+				check(p.HandleTcp(service, client))
+			}(client)
+		}
+	}
+}
+
 func isRunningLocally(service string, serviceEndpoint string, reg proxy.Registry) bool {
 	if endpoints, err := reg.Endpoints(service); err == nil {
 		for _, endpoint := range endpoints {
@@ -68,6 +365,9 @@ func handleServices(confIni *ini.File, p *proxy.IsolationProxy) {
 	confSection, err := confIni.GetSection("services")
 	check(err)
 	for _, service := range confSection.Keys() {
+		if _, err := p.Registry.Endpoints(service.Name()); err != nil {
+			services.L.Warnf("Service %s has no backends, all requests will fail: %v", service.Name(), err)
+		}
 		if !isRunningLocally(service.Name(), service.String(), p.Registry) {
 			go func(service *ini.Key) {
 				check(p.Handle(service.Name(), service.String()))
@@ -79,25 +379,76 @@ func handleServices(confIni *ini.File, p *proxy.IsolationProxy) {
 	}
 }
 
+func joinCluster(p *proxy.IsolationProxy, addr string, peers string) {
+	var peerList []string
+	for _, peer := range strings.Split(peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peerList = append(peerList, peer)
+		}
+	}
+	cluster, err := p.JoinCluster(addr, peerList)
+	check(err)
+	http.HandleFunc(cluster_path, func(w http.ResponseWriter, r *http.Request) {
+		services.Http_respond_json(w, r, cluster.Stats())
+	})
+}
+
 func main() {
 	execFolder, err := osext.ExecutableFolder()
 	check(err)
-	configFile := flag.String("conf", execFolder+"/isolator.ini", "Config containing isolated external services")
-	statsAddr := flag.String("stats", ":7777", "Address to serve statistics (HTTP+JSON on "+stats_path+" and "+runtime_path+")")
+	configFile := flag.String("conf", execFolder+"/isolator.ini", "Config containing isolated external services (.ini or .yaml)")
+	checkConfig := flag.Bool("check-config", false, "Only validate the config and report all problems")
+	statsAddr := flag.String("stats", ":7777", "Address to serve statistics (HTTP+JSON on "+stats_path+", "+stats_path+"/history and "+runtime_path+", Server-Sent Events on "+events_path+", HTML dashboard on "+dashboard_path+", log levels on "+loglevel_path+", canary rollbacks on "+canary_path+")")
 	dialTimeout := flag.Duration("timeout", 5*time.Second, "Timeout for outgoing TCP connections")
+	zone := flag.String("zone", "", "Zone of this isolator, used for zone-aware load balancing (see [zones] in the config)")
+	clusterAddr := flag.String("cluster", "", "UDP address to exchange endpoint states with other isolators (statistics on "+cluster_path+")")
+	trustedPeers := flag.String("trusted-peers", "", "Comma separated IP addresses or CIDR networks whose "+proxy.CriticalityHeader+" header is trusted, it is removed from other requests")
+	peers := flag.String("peers", "", "Comma separated UDP addresses of the other isolators, see -cluster. Messages from other addresses are ignored.")
 	flag.Parse()
 	golib.ConfigureOpenFilesLimit()
 
-	confIni, err := ini.Load(*configFile)
-	check(err)
+	conf, err := loadConfig(*configFile)
+	if err == nil {
+		err = validateConfig(conf)
+	}
+	if *checkConfig {
+		if err != nil {
+			log.Fatalf("Config %v is invalid:\n%v\n", *configFile, err)
+		}
+		log.Printf("Config %v is valid\n", *configFile)
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to load config %v:\n%v\n", *configFile, err)
+	}
+	confIni := conf.File
+	loadZones(confIni)
+	loadEndpointOptions(confIni)
 
-	p := proxy.NewIsolationProxy(
-		loadServiceRegistry(confIni),
-		*dialTimeout,
+	trusted, err := proxy.ParseNetworks(strings.Split(*trustedPeers, ","))
+	if err != nil {
+		log.Fatalf("Illegal -trusted-peers: %v\n", err)
+	}
+	p := proxy.NewIsolationProxyWithOptions(
+		proxy.WithRegistry(loadServiceRegistry(confIni)),
+		proxy.WithDialTimeout(*dialTimeout),
+		proxy.WithZone(*zone),
+		proxy.WithTrustedPeers(trusted...),
 	)
+	loadServiceConfigs(confIni, p)
+	if *clusterAddr != "" {
+		joinCluster(p, *clusterAddr, *peers)
+	}
 	services.EnableResponseLogging()
+	p.RecordHistory()
 	p.ServeStats(stats_path)
+	p.ServeEvents(events_path)
+	proxy.ServeDashboard(dashboard_path, stats_path)
+	p.PublishEvent(proxy.Event{Type: proxy.EventConfig, Message: "Loaded " + *configFile})
 	proxy.ServeRuntimeStats(runtime_path)
+	http.Handle(loglevel_path, services.HandleLogLevels())
+	http.Handle(canary_path, p.HandleCanaries())
 	handleServices(confIni, p)
+	handleTcpServices(confIni, p)
 	check(http.ListenAndServe(*statsAddr, nil))
 }
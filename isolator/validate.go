@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antongulenko/http-isolation-proxy/proxy"
+	"github.com/go-ini/ini"
+)
+
+type configError struct {
+	Line int // 0 if unknown
+	Msg  string
+}
+
+func (err *configError) Error() string {
+	if err.Line > 0 {
+		return fmt.Sprintf("line %d: %s", err.Line, err.Msg)
+	}
+	return err.Msg
+}
+
+// All problems found in a configuration, sorted by line
+type configErrors []*configError
+
+func (errs configErrors) Error() string {
+	sorted := append(configErrors(nil), errs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Line < sorted[j].Line
+	})
+	lines := make([]string, len(sorted))
+	for i, err := range sorted {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Checks a single configuration value
+type valueCheck func(value string) error
+
+var (
+	checkAny = func(string) error { return nil }
+
+	checkInt = func(value string) error {
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err
+	}
+
+	checkPositive = func(value string) error {
+		if n, err := strconv.ParseUint(value, 10, 64); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("Expected a positive number, got %v", value)
+		}
+		return nil
+	}
+
+	checkFloat = func(value string) error {
+		_, err := strconv.ParseFloat(value, 64)
+		return err
+	}
+
+	checkBool = func(value string) error {
+		_, err := strconv.ParseBool(value)
+		return err
+	}
+
+	checkDuration = func(value string) error {
+		_, err := time.ParseDuration(value)
+		return err
+	}
+
+	checkAddress = func(value string) error {
+		_, _, err := net.SplitHostPort(value)
+		return err
+	}
+
+	checkLocality = func(value string) error {
+		_, err := proxy.ParseLocalityPolicy(value)
+		return err
+	}
+
+	checkSlowStartMode = func(value string) error {
+		_, err := proxy.ParseSlowStartMode(value)
+		return err
+	}
+
+	checkQueueOrder = func(value string) error {
+		_, err := proxy.ParseQueueOrder(value)
+		return err
+	}
+
+	checkCriticality = func(value string) error {
+		_, err := proxy.ParseCriticality(value)
+		return err
+	}
+
+	checkHeader = func(value string) error {
+		if key, _ := splitCondition(value, ":"); key == "" || !strings.Contains(value, ":") {
+			return fmt.Errorf("Expected 'Name: value', got '%v'", value)
+		}
+		return nil
+	}
+
+	checkShedThreshold = func(value string) error {
+		key, threshold := splitCondition(value, ":")
+		if err := checkCriticality(key); err != nil {
+			return err
+		}
+		return checkFloat(threshold)
+	}
+
+	checkTcpClient = func(value string) error {
+		values := strings.Split(value, ",")
+		if len(values) > 2 {
+			return fmt.Errorf("Expected 'listen address[, max connections]', got '%v'", value)
+		}
+		if err := checkAddress(strings.TrimSpace(values[0])); err != nil {
+			return err
+		}
+		if len(values) > 1 {
+			return checkInt(strings.TrimSpace(values[1]))
+		}
+		return nil
+	}
+)
+
+// Apply the check to every entry of a comma separated list
+func listOf(check valueCheck) valueCheck {
+	return func(value string) error {
+		for _, entry := range strings.Split(value, ",") {
+			if err := check(strings.TrimSpace(entry)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Keys allowed in [service.<name>] sections
+var serviceKeys = map[string]valueCheck{
+	"timeout":                 checkDuration,
+	"health_check_interval":   checkDuration,
+	"slow_start":              checkDuration,
+	"slow_start_mode":         checkSlowStartMode,
+	"shadow":                  listOf(checkAddress),
+	"shadow_percent":          checkFloat,
+	"shadow_timeout":          checkDuration,
+	"shadow_max_concurrent":   checkInt,
+	"shadow_max_body_size":    checkInt,
+	"hash_header":             checkAny,
+	"hash_cookie":             checkAny,
+	"hash_path":               checkAny,
+	"hash_form":               checkAny,
+	"hash_load_factor":        checkFloat,
+	"flush_interval":          checkDuration,
+	"max_body_size":           checkInt,
+	"max_header_size":         checkInt,
+	"remove_request_headers":  checkAny,
+	"add_request_headers":     listOf(checkHeader),
+	"remove_response_headers": checkAny,
+	"add_response_headers":    listOf(checkHeader),
+	"service_header":          checkBool,
+	"locality":                checkLocality,
+	"locality_max_load":       checkInt,
+	"sticky_cookie":           checkAny,
+	"sticky_form":             checkAny,
+	"canary":                  checkAny,
+	"canary_baseline":         checkAny,
+	"canary_max_error_diff":   checkFloat,
+	"canary_min_requests":     checkInt,
+	"canary_window":           checkDuration,
+	"max_load":                checkInt,
+	"shed_thresholds":         listOf(checkShedThreshold),
+	"queue":                   checkQueueOrder,
+	"queue_max_wait":          checkDuration,
+	"queue_max_size":          checkInt,
+	"queue_max_load":          checkInt,
+}
+
+// Keys allowed in [route.<service>.<name>] sections
+var routeKeys = map[string]valueCheck{
+	"path":        checkAny,
+	"method":      checkAny,
+	"header":      checkAny,
+	"form":        checkAny,
+	"backends":    listOf(checkAddress),
+	"criticality": checkCriticality,
+}
+
+// Keys allowed in [version.<service>.<label>] sections
+var versionKeys = map[string]valueCheck{
+	"backends": listOf(checkAddress),
+	"weight":   checkPositive,
+}
+
+type configValidator struct {
+	conf     *config
+	errors   configErrors
+	services map[string]bool // Services with backends
+}
+
+// Report all problems in the configuration, return nil if there are none
+func validateConfig(conf *config) error {
+	v := &configValidator{
+		conf:     conf,
+		services: make(map[string]bool),
+	}
+	v.validate()
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+func (v *configValidator) errorf(section, key string, format string, args ...interface{}) {
+	v.errors = append(v.errors, &configError{
+		Line: v.conf.line(section, key),
+		Msg:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *configValidator) validate() {
+	if backends, err := v.conf.GetSection("backends"); err != nil {
+		v.errorf("", "", "Missing section [backends]")
+	} else {
+		for _, key := range backends.Keys() {
+			v.services[key.Name()] = true
+			v.checkKey(backends, key, listOf(checkAddress))
+		}
+	}
+	for _, section := range v.conf.Sections() {
+		// Version sections can add backends
+		if strings.HasPrefix(section.Name(), version_section_prefix) && section.HasKey("backends") {
+			service, _ := splitCondition(strings.TrimPrefix(section.Name(), version_section_prefix), ".")
+			v.services[service] = true
+		}
+	}
+	if services, err := v.conf.GetSection("services"); err != nil {
+		v.errorf("", "", "Missing section [services]")
+	} else {
+		for _, key := range services.Keys() {
+			// Services without backends are answered with 503, see handleServices()
+			v.checkKey(services, key, checkAddress)
+		}
+	}
+	for _, section := range v.conf.Sections() {
+		v.validateSection(section)
+	}
+}
+
+func (v *configValidator) validateSection(section *ini.Section) {
+	name := section.Name()
+	switch {
+	case name == "services" || name == "backends":
+		// Checked in validate()
+	case name == "zones":
+		for _, key := range section.Keys() {
+			v.checkKey(section, key, listOf(checkAddress))
+		}
+	case name == ini.DEFAULT_SECTION:
+		for _, key := range section.Keys() {
+			v.errorf(name, key.Name(), "Setting %v outside of any section", key.Name())
+		}
+	case strings.HasPrefix(name, service_section_prefix):
+		v.checkService(name, "", strings.TrimPrefix(name, service_section_prefix))
+		v.checkKeys(section, serviceKeys)
+	case strings.HasPrefix(name, route_section_prefix):
+		if v.checkSubsection(section, route_section_prefix) {
+			v.checkKeys(section, routeKeys)
+			if !section.HasKey("backends") {
+				v.errorf(name, "", "Route [%v] has no backends", name)
+			}
+		}
+	case strings.HasPrefix(name, version_section_prefix):
+		if v.checkSubsection(section, version_section_prefix) {
+			v.checkKeys(section, versionKeys)
+		}
+	case strings.HasPrefix(name, tcp_section_prefix):
+		v.checkService(name, "", strings.TrimPrefix(name, tcp_section_prefix))
+		for _, key := range section.Keys() {
+			v.checkKey(section, key, checkTcpClient)
+		}
+	default:
+		v.errorf(name, "", "Unknown section [%v]", name)
+	}
+}
+
+// Section names like [route.<service>.<name>] must name a service and a subsection
+func (v *configValidator) checkSubsection(section *ini.Section, prefix string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(section.Name(), prefix), ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		v.errorf(section.Name(), "", "Illegal section [%v], expected [%v<service>.<name>]", section.Name(), prefix)
+		return false
+	}
+	v.checkService(section.Name(), "", parts[0])
+	return true
+}
+
+// The service referred to in the section (or key) must have backends
+func (v *configValidator) checkService(section, key, service string) {
+	if !v.services[service] {
+		v.errorf(section, key, "Service %v has no backends", service)
+	}
+}
+
+func (v *configValidator) checkKeys(section *ini.Section, allowed map[string]valueCheck) {
+	for _, key := range section.Keys() {
+		check, ok := allowed[key.Name()]
+		if !ok {
+			v.errorf(section.Name(), key.Name(), "Unknown setting %v in [%v]", key.Name(), section.Name())
+			continue
+		}
+		v.checkKey(section, key, check)
+	}
+}
+
+func (v *configValidator) checkKey(section *ini.Section, key *ini.Key, check valueCheck) {
+	value := key.String()
+	if value == "" {
+		v.errorf(section.Name(), key.Name(), "Missing value for %v in [%v]", key.Name(), section.Name())
+	} else if err := check(value); err != nil {
+		v.errorf(section.Name(), key.Name(), "Illegal value for %v in [%v]: %v", key.Name(), section.Name(), err)
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/antongulenko/http-isolation-proxy/services"
+	"github.com/go-ini/ini"
+)
+
+// Balances the requests of a services.Client between the endpoints registered for the
+// host of each request, with the same health tracking and endpoint selection as the
+// isolator, but without the extra hop. Requests to other hosts are sent unchanged.
+type Balancer struct {
+	// The service names are the host:port pairs used in the request URLs
+	Registry Registry
+	clock    Clock
+}
+
+func NewBalancer(registry Registry) *Balancer {
+	return &Balancer{
+		Registry: registry,
+		clock:    systemClock{},
+	}
+}
+
+// Load a file mapping host:port pairs to lists of endpoints in its default section, e.g.:
+// localhost:9001 = 10.0.0.1:9001, 10.0.0.2:9001
+func LoadBalancer(filename string) (*Balancer, error) {
+	confIni, err := ini.Load(filename)
+	if err != nil {
+		return nil, err
+	}
+	reg := make(LocalRegistry)
+	for _, key := range confIni.Section("").Keys() {
+		for _, addr := range key.Strings(",") {
+			reg.Add(key.Name(), NewEndpoint(key.Name(), addr))
+		}
+	}
+	if len(reg) == 0 {
+		return nil, fmt.Errorf("No balanced endpoints configured in %v", filename)
+	}
+	return NewBalancer(reg), nil
+}
+
+// Can be passed to services.Client.Use()
+func (balancer *Balancer) Middleware(next http.RoundTripper) http.RoundTripper {
+	return services.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		endpoints, err := balancer.Registry.Endpoints(req.URL.Host)
+		if err != nil {
+			return next.RoundTrip(req) // Not balanced
+		}
+		return balancer.roundTrip(next, req, endpoints)
+	})
+}
+
+// Like Director.forwardTo(), try other endpoints when one fails
+func (balancer *Balancer) roundTrip(next http.RoundTripper, req *http.Request, endpoints EndpointCollection) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		endpoint := endpoints.Get()
+		if endpoint == nil {
+			endpoint = emergencyEndpoint(balancer.clock, endpoints)
+		}
+		if endpoint == nil {
+			return nil, fmt.Errorf("Cannot send request to %v: %v", req.URL.Host, noActiveEndpointsErr)
+		}
+		balancedReq, err := balancedRequest(req, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		logger.Tracef("Sending request for %v to %v", req.URL, endpoint)
+		resp, err := endpoint.StreamingRoundTrip(func() (*http.Response, error) {
+			resp, err := next.RoundTrip(balancedReq)
+			if err != nil && req.Context().Err() != nil {
+				return nil, requestAbortedErr
+			}
+			return resp, err
+		})
+		if err == requestAbortedErr {
+			return nil, req.Context().Err()
+		}
+		if err == nil || attempt >= len(endpoints) {
+			return resp, err
+		}
+		logger.Warnf("Error sending request for %v to %v: %v. Will try other endpoint...", req.URL, endpoint, err)
+	}
+}
+
+// A copy of the request addressed to the endpoint, with a fresh body
+func balancedRequest(req *http.Request, endpoint *Endpoint) (*http.Request, error) {
+	result := req.WithContext(req.Context())
+	u := *req.URL
+	endpoint.ConfigureUrl(&u)
+	result.URL = &u
+	result.Host = ""
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		result.Body = body
+	}
+	return result, nil
+}
+
+var balancerConfig string
+
+// Register the -balancedEndpoints flag, see EnableClientBalancing()
+func ParseBalancerFlags() {
+	flag.StringVar(&balancerConfig, "balancedEndpoints", "",
+		"ini-file containing mappings from host:port to a list of host:port to be used instead")
+}
+
+// Balance the requests of services.DefaultClient as configured in the -balancedEndpoints flag,
+// see LoadBalancer(). Must be called after flag.Parse().
+func EnableClientBalancing() {
+	if balancerConfig == "" {
+		return // No configuration given
+	}
+	balancer, err := LoadBalancer(balancerConfig)
+	if err != nil {
+		log.Fatalf("Error loading load balancing config file %v: %v\n", balancerConfig, err)
+	}
+	if logger.LevelEnabled(services.LevelNormal) {
+		logger.Logf("Client-side load balancing enabled for:")
+		for _, host := range balancer.Registry.Services() {
+			endpoints, _ := balancer.Registry.Endpoints(host)
+			hosts := make([]string, 0, len(endpoints))
+			for _, endpoint := range endpoints {
+				hosts = append(hosts, endpoint.Host)
+			}
+			logger.Logf("%v => %v", host, hosts)
+		}
+	}
+	services.DefaultClient.Use(balancer.Middleware)
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/antongulenko/http-isolation-proxy/services"
+)
+
+func TestBalancerAvoidsFailingEndpoint(t *testing.T) {
+	failingBackend := httptest.NewServer(failingHandler)
+	defer failingBackend.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		_, _ = w.Write([]byte(r.Host + r.URL.Path + "?" + r.Form.Get("key")))
+	}))
+	defer backend.Close()
+	failing := NewEndpoint("virtual:80", hostOf(failingBackend), WithEndpointClock(newFakeClock()))
+	healthy := NewEndpoint("virtual:80", hostOf(backend))
+	registry := make(LocalRegistry)
+	registry.Add("virtual:80", failing)
+	registry.Add("virtual:80", healthy)
+	client := &services.Client{}
+	client.Use(NewBalancer(registry).Middleware)
+
+	// The form body must be sent again to the second endpoint
+	body, err := client.PostString(context.Background(), "http://virtual:80/path", url.Values{"key": {"value"}})
+	if expected := hostOf(backend) + "/path?value"; err != nil || body != expected {
+		t.Errorf("Unexpected response %v, %v, expected %v", body, err, expected)
+	}
+	if failing.Active() || failing.Errors() != 1 {
+		t.Errorf("Unexpected state of failing endpoint: %+v", failing.Snapshot())
+	}
+
+	// Not balanced
+	body, err = client.PostString(context.Background(), backend.URL+"/direct", nil)
+	if expected := hostOf(backend) + "/direct?"; err != nil || body != expected {
+		t.Errorf("Unexpected response %v, %v, expected %v", body, err, expected)
+	}
+}
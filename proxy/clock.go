@@ -0,0 +1,46 @@
+package proxy
+
+import "time"
+
+// Source of time for the state machine of endpoints, e.g. online_check_interval and
+// overload_recovery_time. Can be replaced to simulate time in tests.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Default: the system clock
+func WithEndpointClock(clock Clock) EndpointOption {
+	return func(endpoint *Endpoint) {
+		endpoint.timeSource = clock
+	}
+}
+
+// Used when waiting for inactive endpoints. Default: the system clock
+func WithClock(clock Clock) Option {
+	return func(proxy *IsolationProxy) {
+		proxy.clock = clock
+	}
+}
+
+func (endpoint *Endpoint) clock() Clock {
+	if endpoint.timeSource == nil {
+		return systemClock{}
+	}
+	return endpoint.timeSource
+}
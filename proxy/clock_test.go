@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Time only passes when Advance() is called
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+	changed chan struct{} // Closed and replaced whenever a waiter is added
+}
+
+type fakeWaiter struct {
+	until time.Time
+	c     chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+		changed: make(chan struct{}),
+	}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- clock.now
+		return c
+	}
+	clock.waiters = append(clock.waiters, &fakeWaiter{until: clock.now.Add(d), c: c})
+	close(clock.changed)
+	clock.changed = make(chan struct{})
+	return c
+}
+
+func (clock *fakeClock) Sleep(d time.Duration) {
+	<-clock.After(d)
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(d)
+	waiting := clock.waiters[:0]
+	for _, waiter := range clock.waiters {
+		if clock.now.Before(waiter.until) {
+			waiting = append(waiting, waiter)
+		} else {
+			waiter.c <- clock.now
+		}
+	}
+	clock.waiters = waiting
+}
+
+// The number of goroutines currently waiting for the clock
+func (clock *fakeClock) Waiting() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return len(clock.waiters)
+}
+
+// Wait until at least n goroutines are waiting for the clock, fail after a real timeout
+func (clock *fakeClock) BlockUntil(t *testing.T, n int) {
+	timeout := time.After(5 * time.Second)
+	for {
+		clock.lock.Lock()
+		waiting, changed := len(clock.waiters), clock.changed
+		clock.lock.Unlock()
+		if waiting >= n {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %v waiters, have %v", n, waiting)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+)
+
+const cluster_max_message_size = 64 * 1024
+
+// Sent to all peers when the state of an endpoint changes
+type clusterMessage struct {
+	Node     string
+	Service  string
+	Endpoint string
+	State    string // EventActive, EventInactive or EventOverloaded
+	Error    string `json:",omitempty"`
+}
+
+// Shares endpoint state changes between isolators over UDP, so that an endpoint
+// failing for one isolator is avoided by all others without waiting for their own
+// requests to fail. Endpoints are identified by service name and host.
+// Messages are only sent on state changes, lost messages are not repeated.
+// Messages are not authenticated, but only accepted from the addresses of the peers.
+// Isolators send from their listen address, so it must be reachable as configured.
+type Cluster struct {
+	proxy *IsolationProxy
+	conn  *net.UDPConn
+	node  string
+
+	lock     sync.Mutex
+	peers    []*net.UDPAddr
+	known    map[*Endpoint]string // Last state sent or received for each endpoint
+	sent     uint
+	received uint
+	rejected uint // Received from addresses that are not peers
+	applied  uint // Received messages about known endpoints
+}
+
+type ClusterStats struct {
+	Node     string
+	Peers    []string
+	Sent     uint
+	Received uint
+	Rejected uint
+	Applied  uint
+}
+
+// Listen for state changes of other isolators on the given UDP address and send
+// local state changes to the peers. Must be called before Handle() or Handler().
+func (proxy *IsolationProxy) JoinCluster(listen string, peers []string) (*Cluster, error) {
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cluster := &Cluster{
+		proxy: proxy,
+		conn:  conn,
+		node:  conn.LocalAddr().String(),
+		known: make(map[*Endpoint]string),
+	}
+	for _, peer := range peers {
+		if err := cluster.AddPeer(peer); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	proxy.AddStateHook(cluster.stateChanged)
+	go cluster.receive()
+	return cluster, nil
+}
+
+func (cluster *Cluster) AddPeer(peer string) error {
+	addr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		return err
+	}
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	cluster.peers = append(cluster.peers, addr)
+	return nil
+}
+
+// The local UDP address
+func (cluster *Cluster) Node() string {
+	return cluster.node
+}
+
+func (cluster *Cluster) Close() error {
+	return cluster.conn.Close()
+}
+
+func (cluster *Cluster) stateChanged(change StateChange) {
+	msg := clusterMessage{
+		Node:     cluster.node,
+		Service:  change.Endpoint.Service,
+		Endpoint: change.Endpoint.Host,
+		State:    change.State(),
+	}
+	if change.Err != nil {
+		msg.Error = change.Err.Error()
+	}
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	if cluster.known[change.Endpoint] == msg.State {
+		return // Caused by a message from another isolator
+	}
+	cluster.known[change.Endpoint] = msg.State
+	data, err := json.Marshal(msg)
+	if err != nil {
+		logger.Warnf("Failed to encode cluster message: %v", err)
+		return
+	}
+	for _, peer := range cluster.peers {
+		if _, err := cluster.conn.WriteToUDP(data, peer); err != nil {
+			logger.Warnf("Failed to send state of %v to %v: %v", change.Endpoint, peer, err)
+		} else {
+			cluster.sent++
+		}
+	}
+}
+
+func (cluster *Cluster) receive() {
+	buf := make([]byte, cluster_max_message_size)
+	for {
+		n, from, err := cluster.conn.ReadFromUDP(buf)
+		if err != nil {
+			logger.Logf("Stopped receiving cluster messages: %v", err)
+			return
+		}
+		if !cluster.isPeer(from) {
+			cluster.lock.Lock()
+			cluster.rejected++
+			cluster.lock.Unlock()
+			logger.Tracef("Ignoring cluster message from %v, which is not a peer", from)
+			continue
+		}
+		var msg clusterMessage
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			logger.Warnf("Illegal cluster message from %v: %v", from, err)
+			continue
+		}
+		if msg.Node != cluster.node {
+			cluster.lock.Lock()
+			cluster.received++
+			cluster.lock.Unlock()
+			cluster.apply(&msg)
+		}
+	}
+}
+
+func (cluster *Cluster) isPeer(addr *net.UDPAddr) bool {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	for _, peer := range cluster.peers {
+		if peer.Port == addr.Port && peer.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cluster *Cluster) apply(msg *clusterMessage) {
+	endpoints, err := cluster.proxy.Registry.Endpoints(msg.Service)
+	if err != nil {
+		return
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Host != msg.Endpoint {
+			continue
+		}
+		logger.Tracef("%v is %v according to %v", endpoint, msg.State, msg.Node)
+		cluster.lock.Lock()
+		cluster.applied++
+		cluster.known[endpoint] = msg.State
+		cluster.lock.Unlock()
+		err := errors.New("Reported by " + msg.Node)
+		if msg.Error != "" {
+			err = errors.New(msg.Error + " (reported by " + msg.Node + ")")
+		}
+		endpoint.applyRemoteState(msg.State, err)
+	}
+}
+
+func (cluster *Cluster) Stats() *ClusterStats {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	stats := &ClusterStats{
+		Node:     cluster.node,
+		Sent:     cluster.sent,
+		Received: cluster.received,
+		Rejected: cluster.rejected,
+		Applied:  cluster.applied,
+	}
+	for _, peer := range cluster.peers {
+		stats.Peers = append(stats.Peers, peer.String())
+	}
+	return stats
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Wait for the condition, which is changed by another goroutine
+func eventually(t *testing.T, description string, condition func() bool) {
+	timeout := time.After(5 * time.Second)
+	for !condition() {
+		select {
+		case <-timeout:
+			t.Fatalf("Timed out waiting until %v", description)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// A proxy with its own endpoint object for the host, which joined a cluster on localhost
+func newClusterNode(t *testing.T, host string) (*Endpoint, *fakeClock, *Cluster) {
+	clock := newFakeClock()
+	endpoint := NewEndpoint("svc", host, WithEndpointClock(clock))
+	registry := make(LocalRegistry)
+	registry.Add("svc", endpoint)
+	p := NewIsolationProxyWithOptions(WithRegistry(registry))
+	cluster, err := p.JoinCluster("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Handler("svc")
+	return endpoint, clock, cluster
+}
+
+func TestClusterSharesEndpointState(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+	endpointA, clockA, clusterA := newClusterNode(t, hostOf(backend))
+	defer clusterA.Close()
+	endpointB, _, clusterB := newClusterNode(t, hostOf(backend))
+	defer clusterB.Close()
+	if err := clusterA.AddPeer(clusterB.Node()); err != nil {
+		t.Fatal(err)
+	}
+	if err := clusterB.AddPeer(clusterA.Node()); err != nil {
+		t.Fatal(err)
+	}
+
+	endpointA.RoundTrip(func() error { return errors.New("failure") })
+	eventually(t, "the failure is shared", func() bool { return !endpointB.Active() })
+
+	// A recovers through its own background check, B follows
+	clockA.BlockUntil(t, 1)
+	clockA.Advance(online_check_interval)
+	eventually(t, "the recovery is shared", endpointB.Active)
+
+	// The states are not echoed back
+	if sent := clusterB.Stats().Sent; sent != 0 {
+		t.Errorf("B sent %v messages", sent)
+	}
+	if stats := clusterA.Stats(); stats.Sent != 2 || stats.Received != 0 {
+		t.Errorf("Unexpected stats of A: %+v", stats)
+	}
+}
+
+func TestClusterIgnoresUnknownEndpoints(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	defer backend.Close()
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	endpointA, _, clusterA := newClusterNode(t, hostOf(backend))
+	defer clusterA.Close()
+	endpointB, _, clusterB := newClusterNode(t, hostOf(other))
+	defer clusterB.Close()
+	if err := clusterA.AddPeer(clusterB.Node()); err != nil {
+		t.Fatal(err)
+	}
+	if err := clusterB.AddPeer(clusterA.Node()); err != nil {
+		t.Fatal(err)
+	}
+
+	endpointA.RoundTrip(func() error { return errors.New("failure") })
+	eventually(t, "the message is received", func() bool { return clusterB.Stats().Received > 0 })
+	if stats := clusterB.Stats(); !endpointB.Active() || stats.Applied != 0 {
+		t.Errorf("Unrelated %v changed, %v messages applied", endpointB, stats.Applied)
+	}
+}
+
+func TestClusterIgnoresUnknownSenders(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+	endpointA, _, clusterA := newClusterNode(t, hostOf(backend))
+	defer clusterA.Close()
+	endpointB, _, clusterB := newClusterNode(t, hostOf(backend))
+	defer clusterB.Close()
+	if err := clusterA.AddPeer(clusterB.Node()); err != nil {
+		t.Fatal(err)
+	}
+
+	// B does not know A as a peer
+	endpointA.RoundTrip(func() error { return errors.New("failure") })
+	eventually(t, "the message is rejected", func() bool { return clusterB.Stats().Rejected > 0 })
+	if stats := clusterB.Stats(); !endpointB.Active() || stats.Received != 0 {
+		t.Errorf("Message of unknown sender applied: %+v", stats)
+	}
+}
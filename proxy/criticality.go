@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type Criticality string
+
+const (
+	CriticalityCritical  = Criticality("critical")
+	CriticalityNormal    = Criticality("normal")
+	CriticalitySheddable = Criticality("sheddable")
+
+	// Requests can declare their criticality in this header, unless a matching Route defines it.
+	// The header is removed from requests that do not come from a trusted peer, see WithTrustedPeers.
+	CriticalityHeader = "X-Request-Criticality"
+)
+
+var (
+	AllCriticalities = []Criticality{CriticalityCritical, CriticalityNormal, CriticalitySheddable}
+
+	DefaultShedThresholds = map[Criticality]float64{
+		CriticalityCritical:  1.0,
+		CriticalityNormal:    0.8,
+		CriticalitySheddable: 0.5,
+	}
+)
+
+func ParseCriticality(value string) (Criticality, error) {
+	for _, criticality := range AllCriticalities {
+		if Criticality(value) == criticality {
+			return criticality, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown criticality: %v", value)
+}
+
+// Parse IP addresses and networks in CIDR notation, e.g. "10.0.0.0/8" or "192.168.1.5"
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("Illegal IP address: %v", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// Whether the request was received from a trusted peer, which may declare the criticality
+func (proxy *IsolationProxy) trustedPeer(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxy.trustedPeers {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sheds requests when the load of the chosen endpoint approaches MaxLoad concurrent requests.
+// Requests of a class are shed when the load reaches the threshold of the class,
+// which is a fraction of MaxLoad. Less critical requests have lower thresholds,
+// so they are shed first.
+type LoadShedder struct {
+	MaxLoad    int
+	Thresholds map[Criticality]float64 // Classes not contained here use DefaultShedThresholds
+
+	lock     sync.Mutex
+	admitted map[Criticality]uint
+	shed     map[Criticality]uint
+}
+
+type CriticalityStats struct {
+	Admitted uint
+	Shed     uint
+}
+
+func requestCriticality(req *http.Request, route *Route) Criticality {
+	if route != nil && route.Criticality != "" {
+		return route.Criticality
+	}
+	if criticality, err := ParseCriticality(req.Header.Get(CriticalityHeader)); err == nil {
+		return criticality
+	}
+	return CriticalityNormal
+}
+
+func (shedder *LoadShedder) threshold(criticality Criticality) float64 {
+	if threshold, ok := shedder.Thresholds[criticality]; ok {
+		return threshold
+	}
+	return DefaultShedThresholds[criticality]
+}
+
+func (shedder *LoadShedder) admit(endpoint *Endpoint, criticality Criticality) bool {
+	limit := shedder.threshold(criticality) * float64(shedder.MaxLoad)
+	admit := shedder.MaxLoad <= 0 || float64(endpoint.Load()) < limit
+
+	shedder.lock.Lock()
+	defer shedder.lock.Unlock()
+	if shedder.admitted == nil {
+		shedder.admitted = make(map[Criticality]uint)
+		shedder.shed = make(map[Criticality]uint)
+	}
+	if admit {
+		shedder.admitted[criticality]++
+	} else {
+		shedder.shed[criticality]++
+	}
+	return admit
+}
+
+func (shedder *LoadShedder) Stats() map[Criticality]*CriticalityStats {
+	shedder.lock.Lock()
+	defer shedder.lock.Unlock()
+	result := make(map[Criticality]*CriticalityStats)
+	for _, criticality := range AllCriticalities {
+		result[criticality] = &CriticalityStats{
+			Admitted: shedder.admitted[criticality],
+			Shed:     shedder.shed[criticality],
+		}
+	}
+	return result
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCriticalityHeaderOnlyFromTrustedPeers(t *testing.T) {
+	trusted, err := ParseNetworks([]string{"10.0.0.0/8", " 192.168.1.5", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	director := newTestDirector(newFakeClock())
+	WithTrustedPeers(trusted...)(director.proxy)
+	critical := &Route{Name: "critical", Criticality: CriticalityCritical}
+
+	for _, test := range []struct {
+		remote   string
+		route    *Route
+		expected Criticality
+	}{
+		{"10.1.2.3:5000", nil, CriticalitySheddable},
+		{"192.168.1.5:5000", nil, CriticalitySheddable},
+		{"192.168.1.6:5000", nil, CriticalityNormal},
+		{"192.168.1.6:5000", critical, CriticalityCritical},
+		{"", nil, CriticalityNormal},
+	} {
+		req, err := http.NewRequest("GET", "http://svc/path", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.remote
+		req.Header.Set(CriticalityHeader, string(CriticalitySheddable))
+		director.direct(req)
+		if got := requestCriticality(req, test.route); got != test.expected {
+			t.Errorf("Criticality of request from %q: %v, expected %v", test.remote, got, test.expected)
+		}
+	}
+
+	if _, err := ParseNetworks([]string{"10.0.0.300"}); err == nil {
+		t.Errorf("Illegal address accepted")
+	}
+}
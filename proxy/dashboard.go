@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Rates shown in the sparklines of the dashboard, one sample per history_interval
+const dashboard_window = time.Minute
+
+//go:embed dashboard.html
+var dashboard_html string
+
+// Serve a self-contained HTML page rendering the statistics served under statsPath.
+// The page polls the statistics and their history under statsPath + "/history"
+// every second, see ServeStats() and RecordHistory().
+func HandleDashboard(statsPath string) http.Handler {
+	path, _ := json.Marshal(statsPath)
+	window, _ := json.Marshal(dashboard_window.String())
+	page := strings.Replace(dashboard_html, "STATS_PATH", string(path), 1)
+	page = strings.Replace(page, "HISTORY_WINDOW", string(window), 1)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write([]byte(page))
+	})
+}
+
+func ServeDashboard(pattern, statsPath string) {
+	http.Handle(pattern, HandleDashboard(statsPath))
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The deadline of a forwarded request. Unlike context.WithDeadline(), it is enforced with
+// the Clock of the proxy, and it can be lifted when the response headers of an upgraded
+// connection or a streamed response arrive, because those can last arbitrarily long.
+type requestDeadline struct {
+	context.Context // Cancelled when the deadline passes or by finish()
+	clock           Clock
+	deadline        time.Time // In the time of the clock
+	cancel          context.CancelFunc
+	lifted          chan struct{}
+	liftOnce        sync.Once
+	expired         int32 // Accessed atomically
+}
+
+func withRequestDeadline(parent context.Context, clock Clock, deadline time.Time) *requestDeadline {
+	ctx, cancel := context.WithCancel(parent)
+	result := &requestDeadline{
+		Context:  ctx,
+		clock:    clock,
+		deadline: deadline,
+		cancel:   cancel,
+		lifted:   make(chan struct{}),
+	}
+	timeout := clock.After(deadline.Sub(clock.Now()))
+	go func() {
+		select {
+		case <-timeout:
+			atomic.StoreInt32(&result.expired, 1)
+			cancel()
+		case <-result.lifted:
+		case <-ctx.Done():
+		}
+	}()
+	return result
+}
+
+// Converted to the system time, which is used by services.SetDeadlineHeader()
+func (ctx *requestDeadline) Deadline() (time.Time, bool) {
+	deadline := time.Now().Add(ctx.deadline.Sub(ctx.clock.Now()))
+	if parent, ok := ctx.Context.Deadline(); ok && parent.Before(deadline) {
+		return parent, true
+	}
+	return deadline, true
+}
+
+func (ctx *requestDeadline) Err() error {
+	err := ctx.Context.Err()
+	if err != nil && atomic.LoadInt32(&ctx.expired) != 0 {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// The request is no longer cancelled when the deadline passes
+func (ctx *requestDeadline) lift() {
+	ctx.liftOnce.Do(func() {
+		close(ctx.lifted)
+	})
+}
+
+// Release the resources after the request is done
+func (ctx *requestDeadline) finish() {
+	ctx.lift()
+	ctx.cancel()
+}
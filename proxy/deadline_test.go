@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeadlineCancelsSlowResponse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	clock := newFakeClock()
+	director := newTestDirector(clock, NewEndpoint("svc", hostOf(backend), WithEndpointClock(newFakeClock())))
+	director.config.Timeout = time.Second
+
+	result := make(chan int, 1)
+	go func() {
+		status, _ := roundTrip(t, director)
+		result <- status
+	}()
+	clock.BlockUntil(t, 1)
+	clock.Advance(time.Second)
+	select {
+	case status := <-result:
+		if status != http.StatusGatewayTimeout {
+			t.Errorf("Unexpected status after the deadline: %v", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request not cancelled at the deadline")
+	}
+}
+
+func TestDeadlineLiftedForEventStream(t *testing.T) {
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			_, _ = w.Write([]byte("data: event\n\n"))
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer backend.Close()
+	defer close(next)
+	clock := newFakeClock()
+	director := newTestDirector(clock, NewEndpoint("svc", hostOf(backend), WithEndpointClock(newFakeClock())))
+	director.config.Timeout = time.Second
+
+	req, err := http.NewRequest("GET", "http://svc/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	director.direct(req)
+	resp, err := director.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	clock.Advance(time.Hour)
+	next <- struct{}{}
+	reader := bufio.NewReader(resp.Body)
+	for i := 0; i < 4; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("Stream ended after %v lines: %v", i, err)
+		}
+	}
+}
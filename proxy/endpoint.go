@@ -1,14 +1,19 @@
 package proxy
 
 import (
+	"errors"
 	"net"
+	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/antongulenko/http-isolation-proxy/services"
 )
 
+// Returned by round trip functions when the request was aborted by the client or
+// its deadline passed. Such errors do not affect the state of the endpoint.
+var requestAbortedErr = errors.New("Request aborted")
+
 const (
 	overload_request_duration = 10 * time.Second
 	overload_recovery_time    = 2 * time.Second
@@ -16,20 +21,101 @@ const (
 	online_check_timeout      = 500 * time.Millisecond
 )
 
+// Values of Endpoint.state
+const (
+	state_unknown = int32(iota) // Before the first connection check, see TestActive()
+	state_inactive
+	state_active
+	state_overloaded // Inactive, but reachable
+)
+
 type Endpoint struct {
 	Service string
 	Host    string
 
-	active        bool
-	overloaded    bool
+	// Used to split traffic between versions of a service, see VersionSplit
+	Version string
+	Weight  uint
+
+	// Interval for checking the connection of inactive endpoints, online_check_interval if zero
+	CheckInterval time.Duration
+	timeSource    Clock
+
+	// Share of requests is ramped up during this window after becoming active, see SlowStartWeight
+	SlowStart     time.Duration
+	SlowStartMode SlowStartMode
+	activeSince   int64 // UnixNano, accessed atomically
+
+	// Used to prefer endpoints close to the proxy, see Locality
+	Zone      string
+	localOnce sync.Once
+	local     bool
+
+	// Counters, protected by lock
+	lock          sync.Mutex
 	reqs          uint
 	load          int
 	errors        int
-	lock          sync.Mutex
 	totalDuration time.Duration
 
-	activeLock    sync.Mutex
-	activeWaiters []chan<- *Endpoint
+	// Compared by EndpointCollection.Get() instead of reqs. After becoming active again and
+	// during the slow start window, it is rebased to the siblings by startRequest().
+	balanced uint
+	rebasing bool
+	siblings func() EndpointCollection // The endpoints of the service, see LocalRegistry.Add()
+
+	// Changed with locked activeLock, but read atomically
+	state int32
+
+	activeLock     sync.Mutex
+	activeWaiters  []chan<- *Endpoint
+	stateListeners []func(StateChange)
+	stateChanges   []StateChange // Not yet passed to the stateListeners, see unlockActive()
+	notifying      bool
+}
+
+// Reported when an endpoint becomes active or inactive
+type StateChange struct {
+	Endpoint   *Endpoint
+	Active     bool
+	Overloaded bool  // The endpoint is inactive, but reachable
+	Err        error // The reason for becoming inactive, if known
+}
+
+type EndpointOption func(endpoint *Endpoint)
+
+// Label the endpoint with a version, see VersionSplit
+func WithVersion(version string, weight uint) EndpointOption {
+	return func(endpoint *Endpoint) {
+		endpoint.Version = version
+		endpoint.Weight = weight
+	}
+}
+
+// Place the endpoint in a zone, see Locality
+func WithEndpointZone(zone string) EndpointOption {
+	return func(endpoint *Endpoint) {
+		endpoint.Zone = zone
+	}
+}
+
+func WithCheckInterval(interval time.Duration) EndpointOption {
+	return func(endpoint *Endpoint) {
+		endpoint.CheckInterval = interval
+	}
+}
+
+// Create an endpoint and test whether it is reachable
+func NewEndpoint(service, host string, opts ...EndpointOption) *Endpoint {
+	endpoint := &Endpoint{
+		Service: service,
+		Host:    host,
+	}
+	for _, opt := range opts {
+		opt(endpoint)
+	}
+	endpoint.TestActive()
+	return endpoint
 }
 
 func (endpoint *Endpoint) String() string {
@@ -44,89 +130,262 @@ func (endpoint *Endpoint) Name() string {
 	return endpoint.Host
 }
 
+// A consistent view of the counters and state of an endpoint
+type EndpointSnapshot struct {
+	Requests      uint
+	Load          int
+	Errors        int
+	TotalDuration time.Duration
+	Active        bool
+	Overloaded    bool
+}
+
+func (endpoint *Endpoint) Snapshot() EndpointSnapshot {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+	state := atomic.LoadInt32(&endpoint.state)
+	return EndpointSnapshot{
+		Requests:      endpoint.reqs,
+		Load:          endpoint.load,
+		Errors:        endpoint.errors,
+		TotalDuration: endpoint.totalDuration,
+		Active:        state == state_active,
+		Overloaded:    state == state_overloaded,
+	}
+}
+
 func (endpoint *Endpoint) Load() int {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
 	return endpoint.load
 }
 
 func (endpoint *Endpoint) Reqs() uint {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
 	return endpoint.reqs
 }
 
 func (endpoint *Endpoint) Overloaded() bool {
-	return endpoint.overloaded
+	return atomic.LoadInt32(&endpoint.state) == state_overloaded
 }
 
 func (endpoint *Endpoint) Active() bool {
-	return endpoint.active
+	return atomic.LoadInt32(&endpoint.state) == state_active
 }
 
 func (endpoint *Endpoint) Errors() int {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
 	return endpoint.errors
 }
 
 func (endpoint *Endpoint) RoundTrip(roundTripper func() error) {
-	start := time.Now()
+	start := endpoint.startRequest()
+	var err error
+	defer func() {
+		endpoint.finishRequest(start, err, true)
+	}()
+	err = roundTripper()
+}
+
+// Like RoundTrip, but the load of the endpoint is only released when the body of the
+// response is closed, which can take very long for streamed responses and upgraded
+// connections. The duration used to detect overload still ends when the response headers arrive.
+func (endpoint *Endpoint) StreamingRoundTrip(roundTripper func() (*http.Response, error)) (resp *http.Response, err error) {
+	start := endpoint.startRequest()
+	defer func() {
+		endpoint.finishRequest(start, err, err != nil)
+		if err == nil {
+			resp.Body = trackBody(resp.Body, endpoint.releaseLoad)
+		}
+	}()
+	resp, err = roundTripper()
+	return
+}
+
+func (endpoint *Endpoint) startRequest() time.Time {
+	base, rebase := endpoint.rebaseBase()
 	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
 	endpoint.reqs++
 	endpoint.load++
+	if rebase && endpoint.rebasing {
+		// An endpoint that became active again has fewer requests than the others and would
+		// win all comparisons until it caught up. It starts with the requests of the least
+		// used sibling instead, and follows it during its slow start window.
+		endpoint.balanced = base
+		endpoint.rebasing = endpoint.SlowStartWeight() < 1
+		if !endpoint.rebasing {
+			endpoint.balanced++
+		}
+	} else {
+		endpoint.balanced++
+	}
+	return endpoint.clock().Now()
+}
+
+// The least compared requests of the active siblings that are not rebasing themselves,
+// if the endpoint is rebasing. Called without holding the lock of the endpoint.
+func (endpoint *Endpoint) rebaseBase() (base uint, ok bool) {
+	endpoint.lock.Lock()
+	rebasing, siblings := endpoint.rebasing, endpoint.siblings
 	endpoint.lock.Unlock()
-	var err error
-	defer func() {
-		duration := time.Now().Sub(start)
-		endpoint.lock.Lock()
-		defer endpoint.lock.Unlock()
-		endpoint.load--
-		endpoint.totalDuration += duration
-		if duration > overload_request_duration || err != nil {
-			endpoint.errors++
-			defer endpoint.activeLock.Unlock()
-			endpoint.activeLock.Lock()
-			endpoint.setInactive(err)
+	if !rebasing || siblings == nil {
+		return 0, false
+	}
+	for _, sibling := range siblings() {
+		if sibling == endpoint || !sibling.Active() {
+			continue
 		}
-	}()
-	err = roundTripper()
+		if reqs, rebasing := sibling.balancedReqs(); !rebasing && (!ok || reqs < base) {
+			base, ok = reqs, true
+		}
+	}
+	return base, ok
+}
+
+// The values compared by EndpointCollection.Get()
+func (endpoint *Endpoint) balance() (load int, reqs uint) {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+	return endpoint.load, endpoint.balanced
+}
+
+func (endpoint *Endpoint) balancedReqs() (reqs uint, rebasing bool) {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+	return endpoint.balanced, endpoint.rebasing
+}
+
+func (endpoint *Endpoint) releaseLoad() {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+	endpoint.load--
+}
+
+func (endpoint *Endpoint) finishRequest(start time.Time, err error, releaseLoad bool) {
+	duration := endpoint.clock().Now().Sub(start)
+	if !endpoint.countRequest(duration, err, releaseLoad) {
+		return
+	}
+	// Not holding endpoint.lock, setInactive() checks the connection and calls the hooks
+	endpoint.activeLock.Lock()
+	defer endpoint.unlockActive()
+	endpoint.setInactive(err)
 }
 
+// Update the counters after a request, return true if the request failed
+func (endpoint *Endpoint) countRequest(duration time.Duration, err error, releaseLoad bool) bool {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+	if releaseLoad {
+		endpoint.load--
+	}
+	if err == requestAbortedErr {
+		return false // Not the fault of the endpoint
+	}
+	endpoint.totalDuration += duration
+	if duration > overload_request_duration || err != nil {
+		endpoint.errors++
+		return true
+	}
+	return false
+}
+
+// Must be called with locked endpoint.activeLock
 func (endpoint *Endpoint) backgroundCheck() {
-	if endpoint.overloaded {
+	if endpoint.Overloaded() {
 		// In case of overload, just wait some time
 		// to let the endpoint recover from overload
 		go func() {
-			time.Sleep(overload_recovery_time)
+			endpoint.clock().Sleep(overload_recovery_time)
 			endpoint.activeLock.Lock()
-			defer endpoint.activeLock.Unlock()
-			if !endpoint.active && endpoint.overloaded {
+			defer endpoint.unlockActive()
+			if endpoint.Overloaded() {
 				endpoint.setActive()
 			}
 		}()
 	} else {
 		go func() {
-			for {
-				time.Sleep(online_check_interval)
+			done := false
+			for !done {
+				endpoint.clock().Sleep(endpoint.checkInterval())
 				err := endpoint.CheckConnection()
 				func() { // Extra func for defer
 					endpoint.activeLock.Lock()
-					defer endpoint.activeLock.Unlock()
-					if endpoint.active || endpoint.overloaded {
-						return // Something else resolved/changed the situation
-					}
-					if err == nil {
-						endpoint.setActive()
-						return
-					} else {
-						services.L.Tracef("%v offline: %v", endpoint, err)
+					defer endpoint.unlockActive()
+					if !endpoint.Active() && !endpoint.Overloaded() {
+						if err == nil {
+							endpoint.setActive()
+						} else {
+							logger.Tracef("%v offline: %v", endpoint, err)
+							return
+						}
 					}
+					// Resolved here or by something else
+					done = true
 				}()
 			}
 		}()
 	}
 }
 
+func (endpoint *Endpoint) checkInterval() time.Duration {
+	if endpoint.CheckInterval > 0 {
+		return endpoint.CheckInterval
+	}
+	return online_check_interval
+}
+
+// Call the hook whenever the endpoint becomes active or inactive. Hooks are called in
+// the order of the changes, without holding locks of the endpoint, so they can use all
+// its methods. They can run on any goroutine changing the state and should not block.
+func (endpoint *Endpoint) OnStateChange(hook func(StateChange)) {
+	endpoint.activeLock.Lock()
+	defer endpoint.activeLock.Unlock()
+	endpoint.stateListeners = append(endpoint.stateListeners, hook)
+}
+
+// Must be called with locked endpoint.activeLock. The hooks are called by unlockActive().
+func (endpoint *Endpoint) notifyStateChange(err error) {
+	endpoint.stateChanges = append(endpoint.stateChanges, StateChange{
+		Endpoint:   endpoint,
+		Active:     endpoint.Active(),
+		Overloaded: endpoint.Overloaded(),
+		Err:        err,
+	})
+}
+
+// Unlock endpoint.activeLock and pass the queued state changes to the hooks. Only one
+// goroutine calls the hooks at a time, so changes queued meanwhile (also by the hooks
+// themselves) are delivered by that goroutine, in order.
+func (endpoint *Endpoint) unlockActive() {
+	if endpoint.notifying {
+		endpoint.activeLock.Unlock()
+		return
+	}
+	endpoint.notifying = true
+	for len(endpoint.stateChanges) > 0 {
+		changes, listeners := endpoint.stateChanges, endpoint.stateListeners
+		endpoint.stateChanges = nil
+		endpoint.activeLock.Unlock()
+		for _, change := range changes {
+			for _, listener := range listeners {
+				listener(change)
+			}
+		}
+		endpoint.activeLock.Lock()
+	}
+	endpoint.notifying = false
+	endpoint.activeLock.Unlock()
+}
+
 func (endpoint *Endpoint) WaitActive() <-chan *Endpoint {
 	result := make(chan *Endpoint, 1)
 	defer endpoint.activeLock.Unlock()
 	endpoint.activeLock.Lock()
-	if endpoint.active {
+	if endpoint.Active() {
 		result <- endpoint
 	} else {
 		endpoint.activeWaiters = append(endpoint.activeWaiters, result)
@@ -144,8 +403,8 @@ func (endpoint *Endpoint) CheckConnection() error {
 
 func (endpoint *Endpoint) TestActive() {
 	err := endpoint.CheckConnection()
-	defer endpoint.activeLock.Unlock()
 	endpoint.activeLock.Lock()
+	defer endpoint.unlockActive()
 	if err == nil {
 		endpoint.setActive()
 	} else {
@@ -153,24 +412,91 @@ func (endpoint *Endpoint) TestActive() {
 	}
 }
 
-// Must be called with locked endpoint.activeLock
+// Apply a state observed by another proxy, see Cluster. Remote reports of recovery
+// are only trusted if the endpoint is reachable from here. The connection is checked
+// before locking activeLock, to not block finishing requests during the dial.
+func (endpoint *Endpoint) applyRemoteState(state string, err error) {
+	var checkErr error
+	switch state {
+	case EventActive:
+		if endpoint.Active() {
+			return
+		}
+		checkErr = endpoint.CheckConnection()
+	case EventOverloaded:
+		if !endpoint.Active() {
+			return
+		}
+		checkErr = endpoint.CheckConnection() // Should result in overload
+	}
+	endpoint.activeLock.Lock()
+	defer endpoint.unlockActive()
+	switch state {
+	case EventActive:
+		if !endpoint.Active() && checkErr == nil {
+			endpoint.setActive()
+		}
+	case EventOverloaded:
+		if endpoint.Active() {
+			endpoint.setChecked(checkErr)
+		}
+	case EventInactive:
+		// An overloaded endpoint is already checked in the background, see backgroundCheck()
+		if endpoint.Active() {
+			endpoint.setInactive(err)
+		}
+	}
+}
+
+// Must be called with locked endpoint.activeLock. Does nothing if the endpoint is already active.
 func (endpoint *Endpoint) setActive() {
-	services.L.Warnf("%v active", endpoint)
-	endpoint.active = true
-	endpoint.overloaded = false
+	previous := atomic.LoadInt32(&endpoint.state)
+	if previous == state_active {
+		return
+	}
+	logger.Warnf("%v active", endpoint)
+	if previous != state_unknown {
+		// Recovered, not checked for the first time after starting the proxy
+		atomic.StoreInt64(&endpoint.activeSince, endpoint.clock().Now().UnixNano())
+		endpoint.lock.Lock()
+		endpoint.rebasing = true
+		endpoint.lock.Unlock()
+	}
+	atomic.StoreInt32(&endpoint.state, state_active)
 	for _, waiter := range endpoint.activeWaiters {
 		waiter <- endpoint
 	}
+	endpoint.activeWaiters = nil // The waiter channels only have room for one endpoint
+	endpoint.notifyStateChange(nil)
 }
 
-// Must be called with locked endpoint.activeLock
+// Must be called with locked endpoint.activeLock. Does nothing if the state does not change,
+// an inactive endpoint is already checked in the background.
 func (endpoint *Endpoint) setInactive(err error) {
-	services.L.Warnf("%v inactive due to: %v", endpoint, err)
-	endpoint.active = false
+	previous := atomic.LoadInt32(&endpoint.state)
+	if previous == state_inactive || (previous == state_overloaded && err == nil) {
+		return
+	}
 	if err == nil {
 		err = endpoint.CheckConnection()
 	}
-	endpoint.overloaded = err == nil
+	endpoint.setChecked(err)
+}
+
+// Must be called with locked endpoint.activeLock. The endpoint becomes inactive if the
+// connection check failed with the given error, and overloaded otherwise.
+func (endpoint *Endpoint) setChecked(err error) {
+	previous := atomic.LoadInt32(&endpoint.state)
+	state := state_inactive
+	if err == nil {
+		state = state_overloaded
+	}
+	if state == previous {
+		return
+	}
+	logger.Warnf("%v inactive due to: %v", endpoint, err)
+	atomic.StoreInt32(&endpoint.state, state)
+	endpoint.notifyStateChange(err)
 	endpoint.backgroundCheck()
 }
 
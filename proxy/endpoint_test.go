@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Return a local address that nothing listens on
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return addr
+}
+
+func listen(t *testing.T, addr string) net.Listener {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+func waitActive(t *testing.T, endpoint *Endpoint) {
+	select {
+	case <-endpoint.WaitActive():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%v did not become active", endpoint)
+	}
+}
+
+func TestNewEndpointChecksConnection(t *testing.T) {
+	listener := listen(t, "127.0.0.1:0")
+	defer listener.Close()
+	if endpoint := NewEndpoint("svc", listener.Addr().String()); !endpoint.Active() {
+		t.Errorf("%v not active", endpoint)
+	}
+	endpoint := NewEndpoint("svc", freeAddress(t), WithEndpointClock(newFakeClock()))
+	if endpoint.Active() || endpoint.Overloaded() {
+		t.Errorf("Unreachable %v active or overloaded", endpoint)
+	}
+}
+
+func TestEndpointRecoversAfterOutage(t *testing.T) {
+	clock := newFakeClock()
+	addr := freeAddress(t)
+	endpoint := NewEndpoint("svc", addr, WithEndpointClock(clock))
+
+	// Still offline at the first check
+	clock.BlockUntil(t, 1)
+	clock.Advance(online_check_interval)
+	clock.BlockUntil(t, 1)
+	if endpoint.Active() {
+		t.Fatalf("%v active while offline", endpoint)
+	}
+
+	listener := listen(t, addr)
+	defer listener.Close()
+	clock.Advance(online_check_interval)
+	waitActive(t, endpoint)
+}
+
+func TestEndpointOverload(t *testing.T) {
+	clock := newFakeClock()
+	listener := listen(t, "127.0.0.1:0")
+	defer listener.Close()
+	endpoint := NewEndpoint("svc", listener.Addr().String(), WithEndpointClock(clock))
+
+	start := endpoint.startRequest()
+	clock.Advance(overload_request_duration + time.Second)
+	endpoint.finishRequest(start, nil, true)
+	if snapshot := endpoint.Snapshot(); !snapshot.Overloaded || snapshot.Active || snapshot.Errors != 1 || snapshot.Load != 0 {
+		t.Fatalf("Unexpected state after slow request: %+v", snapshot)
+	}
+
+	clock.BlockUntil(t, 1)
+	clock.Advance(overload_recovery_time)
+	waitActive(t, endpoint)
+}
+
+func TestEndpointErrorDeactivates(t *testing.T) {
+	clock := newFakeClock()
+	listener := listen(t, "127.0.0.1:0")
+	defer listener.Close()
+	endpoint := NewEndpoint("svc", listener.Addr().String(), WithEndpointClock(clock))
+	changes := make(chan StateChange, 10)
+	endpoint.OnStateChange(func(change StateChange) { changes <- change })
+
+	failure := errors.New("failure")
+	endpoint.RoundTrip(func() error { return failure })
+	change := <-changes
+	if change.Active || change.Overloaded || change.Err != failure || endpoint.Active() {
+		t.Fatalf("Unexpected state change after error: %+v", change)
+	}
+
+	clock.BlockUntil(t, 1)
+	clock.Advance(online_check_interval)
+	waitActive(t, endpoint)
+	if change := <-changes; !change.Active {
+		t.Errorf("Unexpected state change after recovery: %+v", change)
+	}
+}
+
+func TestEndpointRepeatedErrorsDeactivateOnce(t *testing.T) {
+	clock := newFakeClock()
+	listener := listen(t, "127.0.0.1:0")
+	defer listener.Close()
+	endpoint := NewEndpoint("svc", listener.Addr().String(), WithEndpointClock(clock))
+	changes := make(chan StateChange, 10)
+	endpoint.OnStateChange(func(change StateChange) { changes <- change })
+
+	for i := 0; i < 5; i++ {
+		endpoint.RoundTrip(func() error { return errors.New("failure") })
+	}
+	clock.BlockUntil(t, 1)
+	time.Sleep(50 * time.Millisecond) // Give additional checkers time to start
+	if len(changes) != 1 || clock.Waiting() != 1 {
+		t.Fatalf("Repeated errors caused %v state changes and %v background checks", len(changes), clock.Waiting())
+	}
+	if snapshot := endpoint.Snapshot(); snapshot.Errors != 5 || snapshot.Active {
+		t.Errorf("Unexpected state after repeated errors: %+v", snapshot)
+	}
+
+	clock.Advance(online_check_interval)
+	waitActive(t, endpoint)
+}
+
+func TestEndpointIgnoresAbortedRequests(t *testing.T) {
+	clock := newFakeClock()
+	listener := listen(t, "127.0.0.1:0")
+	defer listener.Close()
+	endpoint := NewEndpoint("svc", listener.Addr().String(), WithEndpointClock(clock))
+
+	start := endpoint.startRequest()
+	clock.Advance(overload_request_duration + time.Second)
+	endpoint.finishRequest(start, requestAbortedErr, true)
+	if snapshot := endpoint.Snapshot(); !snapshot.Active || snapshot.Errors != 0 || snapshot.Requests != 1 || snapshot.Load != 0 {
+		t.Errorf("Unexpected state after aborted request: %+v", snapshot)
+	}
+}
+
+func TestEndpointHookReadsCounters(t *testing.T) {
+	clock := newFakeClock()
+	listener := listen(t, "127.0.0.1:0")
+	defer listener.Close()
+	endpoint := NewEndpoint("svc", listener.Addr().String(), WithEndpointClock(clock))
+	snapshots := make(chan EndpointSnapshot, 10)
+	endpoint.OnStateChange(func(change StateChange) { snapshots <- change.Endpoint.Snapshot() })
+
+	done := make(chan struct{})
+	go func() {
+		endpoint.RoundTrip(func() error { return errors.New("failure") })
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Failed request did not finish, state hook reading the endpoint blocked")
+	}
+	if snapshot := <-snapshots; snapshot.Errors != 1 || snapshot.Load != 0 {
+		t.Errorf("Unexpected snapshot in state hook: %+v", snapshot)
+	}
+}
+
+func TestEndpointHookWaitsActive(t *testing.T) {
+	clock := newFakeClock()
+	listener := listen(t, "127.0.0.1:0")
+	defer listener.Close()
+	endpoint := NewEndpoint("svc", listener.Addr().String(), WithEndpointClock(clock))
+	recovered := make(chan *Endpoint, 10)
+	endpoint.OnStateChange(func(change StateChange) {
+		if change.Active {
+			recovered <- <-change.Endpoint.WaitActive()
+		}
+	})
+
+	endpoint.RoundTrip(func() error { return errors.New("failure") })
+	clock.BlockUntil(t, 1)
+	clock.Advance(online_check_interval)
+	select {
+	case got := <-recovered:
+		if got != endpoint {
+			t.Errorf("WaitActive() in state hook returned %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("State hook calling WaitActive() blocked")
+	}
+}
+
+func TestEndpointIgnoresRemoteStateOfInactive(t *testing.T) {
+	clock := newFakeClock()
+	listener := listen(t, "127.0.0.1:0")
+	defer listener.Close()
+	endpoint := NewEndpoint("svc", listener.Addr().String(), WithEndpointClock(clock))
+	start := endpoint.startRequest()
+	clock.Advance(overload_request_duration + time.Second)
+	endpoint.finishRequest(start, nil, true)
+	clock.BlockUntil(t, 1)
+
+	changes := make(chan StateChange, 10)
+	endpoint.OnStateChange(func(change StateChange) { changes <- change })
+	endpoint.applyRemoteState(EventInactive, errors.New("remote failure"))
+	endpoint.applyRemoteState(EventOverloaded, nil)
+	if !endpoint.Overloaded() || len(changes) != 0 {
+		t.Errorf("Remote state changed overloaded endpoint: overloaded %v, changes %v", endpoint.Overloaded(), len(changes))
+	}
+	clock.Advance(overload_recovery_time)
+	waitActive(t, endpoint)
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/antongulenko/http-isolation-proxy/services"
+)
+
+const (
+	EventActive     = "active"
+	EventInactive   = "inactive"
+	EventOverloaded = "overloaded"
+	EventConfig     = "config"  // Published once by the isolator after loading its configuration at startup
+	EventCircuit    = "circuit" // A canary version was rolled back, see VersionSplit
+
+	// Only changes of the endpoint states are published, not every failed request.
+	// The services.CircuitBreaker runs in the clients of the services, its circuits
+	// opening and closing are not part of this stream.
+
+	// Events are dropped for subscribers that cannot keep up.
+	// New subscribers first receive up to this many recent events.
+	event_buffer_size = 100
+)
+
+type Event struct {
+	Type     string
+	Time     time.Time
+	Service  string `json:",omitempty"`
+	Endpoint string `json:",omitempty"`
+	Message  string `json:",omitempty"`
+}
+
+type eventStream struct {
+	lock        sync.Mutex
+	subscribers map[chan Event]bool
+	recent      []Event
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{
+		subscribers: make(map[chan Event]bool),
+	}
+}
+
+func (stream *eventStream) subscribe() chan Event {
+	events := make(chan Event, event_buffer_size)
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	for _, event := range stream.recent {
+		events <- event
+	}
+	stream.subscribers[events] = true
+	return events
+}
+
+func (stream *eventStream) unsubscribe(events chan Event) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	delete(stream.subscribers, events)
+}
+
+func (stream *eventStream) publish(event Event) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	if len(stream.recent) >= event_buffer_size {
+		stream.recent = stream.recent[1:]
+	}
+	stream.recent = append(stream.recent, event)
+	for events := range stream.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// Send the event to all clients of HandleEvents()
+func (proxy *IsolationProxy) PublishEvent(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	proxy.events.publish(event)
+}
+
+// Return EventActive, EventInactive or EventOverloaded
+func (change StateChange) State() string {
+	switch {
+	case change.Active:
+		return EventActive
+	case change.Overloaded:
+		return EventOverloaded
+	default:
+		return EventInactive
+	}
+}
+
+func (proxy *IsolationProxy) publishStateChange(change StateChange) {
+	event := Event{
+		Type:     change.State(),
+		Service:  change.Endpoint.Service,
+		Endpoint: change.Endpoint.Host,
+	}
+	if change.Err != nil {
+		event.Message = change.Err.Error()
+	}
+	proxy.PublishEvent(event)
+}
+
+// Stream all events as Server-Sent Events, the event data is the JSON encoded Event
+func (proxy *IsolationProxy) HandleEvents() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			services.Http_respond_error(w, r, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		events := proxy.events.subscribe()
+		defer proxy.events.unsubscribe(events)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-events:
+				data, err := json.Marshal(event)
+				if err != nil {
+					logger.Warnf("Failed to encode event: %v", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+func (proxy *IsolationProxy) ServeEvents(pattern string) {
+	http.Handle(pattern, proxy.HandleEvents())
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEventsOnlyForStateChanges(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+	clock := newFakeClock()
+	endpoint := NewEndpoint("svc", hostOf(backend), WithEndpointClock(clock))
+	registry := make(LocalRegistry)
+	registry.Add("svc", endpoint)
+	p := NewIsolationProxyWithOptions(WithRegistry(registry))
+	p.Handler("svc") // Publishes the state changes
+	events := p.events.subscribe()
+
+	for i := 0; i < 5; i++ {
+		endpoint.RoundTrip(func() error { return errors.New("failure") })
+	}
+	endpoint.TestActive()
+	if len(events) != 2 {
+		t.Fatalf("%v events, expected inactive and active", len(events))
+	}
+	if first, second := <-events, <-events; first.Type != EventInactive || first.Message != "failure" || second.Type != EventActive {
+		t.Errorf("Unexpected events: %+v, %+v", first, second)
+	}
+	endpoint.TestActive()
+	if len(events) != 0 {
+		t.Errorf("Event published for an endpoint that stayed active: %+v", <-events)
+	}
+}
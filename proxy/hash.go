@@ -0,0 +1,230 @@
+package proxy
+
+import (
+	"hash/crc32"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	hash_ring_replicas        = 100
+	default_hash_load_factor  = 1.25
+	path_variable_open_brace  = "{"
+	path_variable_close_brace = "}"
+)
+
+// Selects endpoints using a consistent hash ring, so that requests with the same key
+// are handled by the same endpoint. If that endpoint is inactive or has more than
+// LoadFactor times the average load, the next endpoint on the ring is used
+// (consistent hashing with bounded loads).
+// The key is taken from the first of Header, Cookie, Path and FormKey present in the request.
+type ConsistentHash struct {
+	Header string
+	Cookie string
+
+	// Pattern like /account/{id}: the segment in braces is used as key.
+	// Other segments are matched like the Path of a Route.
+	Path string
+
+	FormKey    string
+	LoadFactor float64
+
+	lock       sync.Mutex
+	hashRing   *hashRing
+	hashed     uint
+	unhashed   uint
+	spillovers uint
+}
+
+type HashStats struct {
+	Hashed     uint
+	Unhashed   uint
+	Spillovers uint
+}
+
+type hashRing struct {
+	hosts     []string
+	points    []uint32
+	endpoints map[uint32]*Endpoint
+}
+
+func newHashRing(endpoints EndpointCollection) *hashRing {
+	ring := &hashRing{
+		endpoints: make(map[uint32]*Endpoint),
+	}
+	for _, endpoint := range endpoints {
+		ring.hosts = append(ring.hosts, endpoint.Host)
+		for i := 0; i < hash_ring_replicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(endpoint.Host + "#" + strconv.Itoa(i)))
+			if _, ok := ring.endpoints[point]; ok {
+				continue // Extremely unlikely collision, the first endpoint wins
+			}
+			ring.endpoints[point] = endpoint
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Sort(pointSlice(ring.points))
+	return ring
+}
+
+type pointSlice []uint32
+
+func (p pointSlice) Len() int           { return len(p) }
+func (p pointSlice) Less(i, j int) bool { return p[i] < p[j] }
+func (p pointSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Walk the ring clockwise starting at the key, return the first endpoint accepted by the filter
+func (ring *hashRing) walk(key string, accept func(*Endpoint) bool) *Endpoint {
+	if len(ring.points) == 0 {
+		return nil
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	checked := make(map[*Endpoint]bool)
+	for i := 0; i < len(ring.points); i++ {
+		endpoint := ring.endpoints[ring.points[(start+i)%len(ring.points)]]
+		if checked[endpoint] {
+			continue
+		}
+		if accept(endpoint) {
+			return endpoint
+		}
+		checked[endpoint] = true
+	}
+	return nil
+}
+
+// The ring contains all endpoints of the service, so that the endpoint of a key does not
+// change when requests are restricted to a subset of the endpoints. It is only rebuilt
+// when the endpoints of the service change.
+func (hash *ConsistentHash) ring(endpoints EndpointCollection) *hashRing {
+	hash.lock.Lock()
+	defer hash.lock.Unlock()
+	if hash.hashRing == nil || !hash.hashRing.contains(endpoints) {
+		hash.hashRing = newHashRing(endpoints)
+	}
+	return hash.hashRing
+}
+
+func (ring *hashRing) contains(endpoints EndpointCollection) bool {
+	if len(ring.hosts) != len(endpoints) {
+		return false
+	}
+	for i, endpoint := range endpoints {
+		if ring.hosts[i] != endpoint.Host {
+			return false
+		}
+	}
+	return true
+}
+
+func (hash *ConsistentHash) key(req *http.Request) string {
+	if hash.Header != "" {
+		if value := req.Header.Get(hash.Header); value != "" {
+			return value
+		}
+	}
+	if hash.Cookie != "" {
+		if cookie, err := req.Cookie(hash.Cookie); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	if hash.Path != "" {
+		if value := pathVariable(hash.Path, req.URL.Path); value != "" {
+			return value
+		}
+	}
+	if hash.FormKey != "" {
+		if form, err := formValues(req); err == nil {
+			return form.Get(hash.FormKey)
+		}
+	}
+	return ""
+}
+
+func pathVariable(pattern, path string) string {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(pathSegments) < len(patternSegments) {
+		return ""
+	}
+	var result string
+	for i, segment := range patternSegments {
+		switch {
+		case strings.HasPrefix(segment, path_variable_open_brace) && strings.HasSuffix(segment, path_variable_close_brace):
+			result = pathSegments[i]
+		case segment != path_wildcard && segment != pathSegments[i]:
+			return ""
+		}
+	}
+	return result
+}
+
+// Return one of the available endpoints, which must be a subset of all endpoints of the service.
+// Return nil if the request contains no key or no endpoint can take the request.
+// The caller should fall back to the regular load balancing in that case.
+func (hash *ConsistentHash) get(req *http.Request, all, available EndpointCollection) *Endpoint {
+	key := hash.key(req)
+	if key == "" {
+		hash.count(&hash.unhashed)
+		return nil
+	}
+	capacity := hash.capacity(available)
+	accepted := make(map[*Endpoint]bool, len(available))
+	for _, endpoint := range available {
+		accepted[endpoint] = true
+	}
+	ring := hash.ring(all)
+	endpoint := ring.walk(key, func(endpoint *Endpoint) bool {
+		return accepted[endpoint] && endpoint.Active() && endpoint.Load() < capacity
+	})
+	if endpoint == nil {
+		return nil
+	}
+	hash.count(&hash.hashed)
+	if owner := ring.walk(key, func(endpoint *Endpoint) bool { return accepted[endpoint] }); owner != endpoint {
+		logger.Tracef("Hash key %s of %s spilled over to %v", key, req.URL.Path, endpoint)
+		hash.count(&hash.spillovers)
+	}
+	return endpoint
+}
+
+// Maximum load per endpoint, including the new request
+func (hash *ConsistentHash) capacity(endpoints EndpointCollection) int {
+	factor := hash.LoadFactor
+	if factor <= 0 {
+		factor = default_hash_load_factor
+	}
+	totalLoad := 1 // Include the new request
+	numActive := 0
+	for _, endpoint := range endpoints {
+		if endpoint.Active() {
+			totalLoad += endpoint.Load()
+			numActive++
+		}
+	}
+	if numActive == 0 {
+		return 0
+	}
+	return int(math.Ceil(factor * float64(totalLoad) / float64(numActive)))
+}
+
+func (hash *ConsistentHash) count(counter *uint) {
+	hash.lock.Lock()
+	defer hash.lock.Unlock()
+	*counter++
+}
+
+func (hash *ConsistentHash) Stats() *HashStats {
+	hash.lock.Lock()
+	defer hash.lock.Unlock()
+	return &HashStats{
+		Hashed:     hash.hashed,
+		Unhashed:   hash.unhashed,
+		Spillovers: hash.spillovers,
+	}
+}
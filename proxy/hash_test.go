@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestHashRingSharedBySubsets(t *testing.T) {
+	all := EndpointCollection{
+		testEndpoint("a:1", state_active, 0, 0),
+		testEndpoint("b:1", state_active, 0, 0),
+		testEndpoint("c:1", state_active, 0, 0),
+	}
+	hash := &ConsistentHash{Header: "X-Key"}
+	get := func(key string, available EndpointCollection) *Endpoint {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Key", key)
+		return hash.get(req, all, available)
+	}
+	ring := hash.ring(all)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		owner := get(key, all)
+		for _, endpoint := range all {
+			if endpoint == owner {
+				continue
+			}
+			// Removing another endpoint from the subset does not move the key
+			subset := EndpointCollection{}
+			for _, other := range all {
+				if other != endpoint {
+					subset = append(subset, other)
+				}
+			}
+			if got := get(key, subset); got != owner {
+				t.Fatalf("Key %v moved from %v to %v without %v", key, owner, got, endpoint)
+			}
+		}
+	}
+	if hash.ring(all) != ring {
+		t.Errorf("Ring rebuilt for subsets of the same endpoints")
+	}
+	if stats := hash.Stats(); stats.Spillovers != 0 || stats.Hashed != 300 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if hash.ring(all[:2]) == ring {
+		t.Errorf("Ring not rebuilt for changed endpoints")
+	}
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antongulenko/http-isolation-proxy/services"
+)
+
+const (
+	history_interval = time.Second
+	history_size     = 600 // Samples kept, i.e. 10 minutes
+)
+
+// Rates of one endpoint or service in a time interval
+type RateStats struct {
+	Time              *time.Time `json:",omitempty"` // End of the interval, only in the history
+	Interval          string
+	RequestsPerSecond float64
+	ErrorsPerSecond   float64
+	AvgDuration       string
+	AvgDurationMillis float64 // AvgDuration as a number, zero without requests
+
+	requests      uint
+	errors        int
+	totalDuration time.Duration
+}
+
+type ServiceHistory struct {
+	Intervals []*RateStats
+	Endpoints map[string][]*RateStats
+}
+
+type HistoryStats map[string]*ServiceHistory
+
+type counters struct {
+	reqs          uint
+	errors        int
+	totalDuration time.Duration
+}
+
+// Cumulative counters of all endpoints at one point in time, by service and endpoint name
+type snapshot struct {
+	time     time.Time
+	services map[string]map[string]counters
+}
+
+// Ring buffer of snapshots taken every history_interval
+type statsHistory struct {
+	once      sync.Once
+	started   int32 // Accessed atomically
+	lock      sync.Mutex
+	snapshots []*snapshot
+	next      int
+}
+
+func (proxy *IsolationProxy) snapshot() *snapshot {
+	result := &snapshot{
+		time:     proxy.clock.Now(),
+		services: make(map[string]map[string]counters),
+	}
+	for _, service := range proxy.Registry.Services() {
+		endpoints, err := proxy.Registry.Endpoints(service)
+		if err != nil {
+			continue
+		}
+		endpoints = proxy.serviceEndpoints(service, endpoints)
+		serviceCounters := make(map[string]counters, len(endpoints))
+		for _, endpoint := range endpoints {
+			current := endpoint.Snapshot()
+			serviceCounters[endpoint.Name()] = counters{
+				reqs:          current.Requests,
+				errors:        current.Errors,
+				totalDuration: current.TotalDuration,
+			}
+		}
+		result.services[service] = serviceCounters
+	}
+	return result
+}
+
+// Start taking snapshots every history_interval of the proxy clock, if not done yet,
+// until Close() is called. Required for the windowed statistics, the history and for
+// checking canaries.
+func (proxy *IsolationProxy) RecordHistory() {
+	proxy.history.once.Do(func() {
+		atomic.StoreInt32(&proxy.history.started, 1)
+		go proxy.recordHistory()
+	})
+}
+
+func (proxy *IsolationProxy) recordHistory() {
+	next := proxy.clock.Now()
+	for {
+		select {
+		case <-proxy.stop:
+			return
+		default:
+		}
+		now := proxy.snapshot()
+		proxy.history.add(now)
+		proxy.checkCanaries(now)
+
+		// Like a ticker, a slow snapshot does not delay the following ones
+		next = next.Add(history_interval)
+		select {
+		case <-proxy.clock.After(next.Sub(proxy.clock.Now())):
+		case <-proxy.stop:
+		}
+	}
+}
+
+func (history *statsHistory) recording() bool {
+	return atomic.LoadInt32(&history.started) != 0
+}
+
+func (history *statsHistory) add(snap *snapshot) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	if len(history.snapshots) < history_size {
+		history.snapshots = append(history.snapshots, snap)
+	} else {
+		history.snapshots[history.next] = snap
+	}
+	history.next = (history.next + 1) % history_size
+}
+
+// All snapshots, oldest first
+func (history *statsHistory) ordered() []*snapshot {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	if len(history.snapshots) < history_size {
+		return append([]*snapshot(nil), history.snapshots...)
+	}
+	return append(append([]*snapshot(nil), history.snapshots[history.next:]...), history.snapshots[:history.next]...)
+}
+
+// The newest snapshot taken at least window before now, or the oldest snapshot
+func (history *statsHistory) since(now time.Time, window time.Duration) *snapshot {
+	snapshots := history.ordered()
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].time.After(now.Add(-window)) {
+			return snapshots[i]
+		}
+	}
+	if len(snapshots) > 0 {
+		return snapshots[0]
+	}
+	return nil
+}
+
+func (rate *RateStats) add(from, to counters) {
+	rate.requests += to.reqs - from.reqs
+	rate.errors += to.errors - from.errors
+	rate.totalDuration += to.totalDuration - from.totalDuration
+}
+
+func (rate *RateStats) compute(interval time.Duration) {
+	rate.Interval = interval.String()
+	if seconds := interval.Seconds(); seconds > 0 {
+		rate.RequestsPerSecond = float64(rate.requests) / seconds
+		rate.ErrorsPerSecond = float64(rate.errors) / seconds
+	}
+	if rate.requests == 0 {
+		rate.AvgDuration = "(no data)"
+	} else {
+		avg := rate.totalDuration / time.Duration(rate.requests)
+		rate.AvgDuration = avg.String()
+		rate.AvgDurationMillis = float64(avg) / float64(time.Millisecond)
+	}
+}
+
+// Compute the rates between two snapshots for all services and their endpoints
+func ratesBetween(from, to *snapshot) (map[string]*RateStats, map[string]map[string]*RateStats) {
+	interval := to.time.Sub(from.time)
+	serviceRates := make(map[string]*RateStats)
+	endpointRates := make(map[string]map[string]*RateStats)
+	for service, endpoints := range to.services {
+		serviceRate := new(RateStats)
+		endpointRates[service] = make(map[string]*RateStats)
+		for name, current := range endpoints {
+			previous := from.services[service][name] // Zero for new endpoints
+			rate := new(RateStats)
+			rate.add(previous, current)
+			rate.compute(interval)
+			serviceRate.add(previous, current)
+			endpointRates[service][name] = rate
+		}
+		serviceRate.compute(interval)
+		serviceRates[service] = serviceRate
+	}
+	return serviceRates, endpointRates
+}
+
+// Add the rates in the given window before now to the statistics
+func (proxy *IsolationProxy) fillWindow(stats ProxyStats, window time.Duration) {
+	now := proxy.snapshot()
+	from := proxy.history.since(now.time, window)
+	if from == nil {
+		return
+	}
+	serviceRates, endpointRates := ratesBetween(from, now)
+	for service, serviceStats := range stats {
+		serviceStats.Window = serviceRates[service]
+		for name, endpointStats := range serviceStats.Endpoints {
+			endpointStats.Window = endpointRates[service][name]
+			serviceStats.Endpoints[name] = endpointStats
+		}
+	}
+}
+
+// Rates of all recorded intervals, limited to the given window if it is positive
+func (proxy *IsolationProxy) History(window time.Duration) HistoryStats {
+	result := make(HistoryStats)
+	snapshots := proxy.history.ordered()
+	if window > 0 && len(snapshots) > 0 {
+		start := snapshots[len(snapshots)-1].time.Add(-window)
+		for len(snapshots) > 1 && snapshots[0].time.Before(start) {
+			snapshots = snapshots[1:]
+		}
+	}
+	for i := 1; i < len(snapshots); i++ {
+		end := snapshots[i].time
+		serviceRates, endpointRates := ratesBetween(snapshots[i-1], snapshots[i])
+		for service, rate := range serviceRates {
+			history, ok := result[service]
+			if !ok {
+				history = &ServiceHistory{Endpoints: make(map[string][]*RateStats)}
+				result[service] = history
+			}
+			rate.Time = &end
+			history.Intervals = append(history.Intervals, rate)
+			for name, endpointRate := range endpointRates[service] {
+				endpointRate.Time = &end
+				history.Endpoints[name] = append(history.Endpoints[name], endpointRate)
+			}
+		}
+	}
+	return result
+}
+
+// Parse the optional window query parameter, respond with an error if it is invalid
+func parseWindow(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	value := r.URL.Query().Get("window")
+	if value == "" {
+		return 0, true
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		services.Http_respond_error(w, r, "Illegal window: "+value, http.StatusBadRequest)
+		return 0, false
+	}
+	return window, true
+}
+
+// Serve the History(), which is empty without RecordHistory()
+func (proxy *IsolationProxy) HandleHistory() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if window, ok := parseWindow(w, r); ok {
+			services.Http_respond_json(w, r, proxy.History(window))
+		}
+	})
+}
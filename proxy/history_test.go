@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordHistoryUsesClock(t *testing.T) {
+	clock := newFakeClock()
+	registry := make(LocalRegistry)
+	registry.Add("svc", testEndpoint("a:1", state_active, 0, 0))
+	p := NewIsolationProxyWithOptions(WithRegistry(registry), WithClock(clock))
+	defer p.Close()
+	recorded := func() int { return len(p.history.ordered()) }
+	if recorded() != 0 {
+		t.Fatalf("History recorded before RecordHistory()")
+	}
+
+	p.RecordHistory()
+	p.RecordHistory() // Only started once
+	clock.BlockUntil(t, 1)
+	if snapshots := p.history.ordered(); len(snapshots) != 1 || !snapshots[0].time.Equal(clock.Now()) {
+		t.Fatalf("Unexpected first snapshots: %v", snapshots)
+	}
+	clock.Advance(history_interval)
+	eventually(t, "the second snapshot is taken", func() bool { return recorded() == 2 })
+	if history := p.History(0); len(history["svc"].Intervals) != 1 || history["svc"].Intervals[0].Interval != "1s" {
+		t.Errorf("Unexpected history: %+v", history["svc"])
+	}
+
+	clock.BlockUntil(t, 1)
+	p.Close()
+	clock.Advance(history_interval)
+	time.Sleep(10 * time.Millisecond)
+	if n := recorded(); n != 2 {
+		t.Errorf("History recorded after Close(): %v snapshots", n)
+	}
+}
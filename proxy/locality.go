@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+)
+
+type LocalityPolicy string
+
+const (
+	// Ignore the location of endpoints
+	LocalityNone = LocalityPolicy("none")
+
+	// Prefer endpoints on the local host, then all others
+	LocalityLocal = LocalityPolicy("local")
+
+	// Prefer endpoints on the local host, then endpoints in the same zone, then all others
+	LocalityZone = LocalityPolicy("zone")
+)
+
+const (
+	tier_local = iota
+	tier_zone
+	tier_remote
+	num_tiers
+)
+
+var tierNames = [num_tiers]string{"Local", "Zone", "Remote"}
+
+func ParseLocalityPolicy(policy string) (LocalityPolicy, error) {
+	switch result := LocalityPolicy(policy); result {
+	case "":
+		return LocalityNone, nil
+	case LocalityNone, LocalityLocal, LocalityZone:
+		return result, nil
+	default:
+		return "", fmt.Errorf("Unknown locality policy: %v", policy)
+	}
+}
+
+// Restricts the endpoints of a service to the closest ones that are not overloaded.
+// An endpoint counts as overloaded when it is inactive or, if MaxLoad is positive,
+// when its load reaches MaxLoad.
+type Locality struct {
+	Policy  LocalityPolicy
+	MaxLoad int
+
+	lock  sync.Mutex
+	picks [num_tiers]uint
+}
+
+type LocalityStats struct {
+	Policy LocalityPolicy
+	Picks  map[string]uint
+}
+
+// Cached, because LocalPort() queries the network interfaces
+func (endpoint *Endpoint) IsLocal() bool {
+	endpoint.localOnce.Do(func() {
+		port, err := endpoint.LocalPort()
+		if err != nil {
+			logger.Warnf("Failed to check if %v is local: %v", endpoint, err)
+		}
+		endpoint.local = port != ""
+	})
+	return endpoint.local
+}
+
+func (locality *Locality) tier(endpoint *Endpoint, zone string) int {
+	if endpoint.IsLocal() {
+		return tier_local
+	}
+	if locality.Policy == LocalityZone && zone != "" && endpoint.Zone == zone {
+		return tier_zone
+	}
+	return tier_remote
+}
+
+func (locality *Locality) available(endpoint *Endpoint) bool {
+	return endpoint.Active() && (locality.MaxLoad <= 0 || endpoint.Load() < locality.MaxLoad)
+}
+
+// zone is the zone of the proxy itself
+func (locality *Locality) filter(endpoints EndpointCollection, zone string) EndpointCollection {
+	if locality.Policy == LocalityNone || locality.Policy == "" {
+		return endpoints
+	}
+	var tiers [num_tiers]EndpointCollection
+	for _, endpoint := range endpoints {
+		if locality.available(endpoint) {
+			tier := locality.tier(endpoint, zone)
+			tiers[tier] = append(tiers[tier], endpoint)
+		}
+	}
+	for tier, candidates := range tiers {
+		if len(candidates) > 0 {
+			locality.lock.Lock()
+			locality.picks[tier]++
+			locality.lock.Unlock()
+			return candidates
+		}
+	}
+	return endpoints
+}
+
+func (locality *Locality) Stats() *LocalityStats {
+	locality.lock.Lock()
+	defer locality.lock.Unlock()
+	stats := &LocalityStats{
+		Policy: locality.Policy,
+		Picks:  make(map[string]uint),
+	}
+	for tier, picks := range locality.picks {
+		stats.Picks[tierNames[tier]] = picks
+	}
+	return stats
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+const default_dial_timeout = 5 * time.Second
+
+type Option func(proxy *IsolationProxy)
+
+// Default: an empty LocalRegistry
+func WithRegistry(registry Registry) Option {
+	return func(proxy *IsolationProxy) {
+		proxy.Registry = registry
+	}
+}
+
+// Timeout for connecting to endpoints. Default: default_dial_timeout
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(proxy *IsolationProxy) {
+		proxy.dialTimeout = timeout
+	}
+}
+
+// Zone of the proxy itself, see Locality
+func WithZone(zone string) Option {
+	return func(proxy *IsolationProxy) {
+		proxy.Zone = zone
+	}
+}
+
+// Networks of other proxies and services that may declare the criticality of their requests
+// in the CriticalityHeader, see ParseNetworks(). The header is removed from all other requests,
+// so that clients cannot bypass the LoadShedder. Default: none
+func WithTrustedPeers(networks ...*net.IPNet) Option {
+	return func(proxy *IsolationProxy) {
+		proxy.trustedPeers = append(proxy.trustedPeers, networks...)
+	}
+}
+
+// Call the hook when an endpoint of a handled service becomes active or inactive,
+// see Endpoint.OnStateChange() and AddStateHook()
+func OnStateChange(hook func(StateChange)) Option {
+	return func(proxy *IsolationProxy) {
+		proxy.AddStateHook(hook)
+	}
+}
+
+// Call the hook after every proxied request, see AddRequestHook()
+func OnRequest(hook func(RequestEvent)) Option {
+	return func(proxy *IsolationProxy) {
+		proxy.AddRequestHook(hook)
+	}
+}
+
+// Like OnStateChange(), but can also be called after Handler(): the hook is
+// registered on the endpoints of the services handled so far as well
+func (proxy *IsolationProxy) AddStateHook(hook func(StateChange)) {
+	proxy.hooksLock.Lock()
+	defer proxy.hooksLock.Unlock()
+	proxy.stateHooks = append(proxy.stateHooks, hook)
+	for endpoint := range proxy.observed {
+		endpoint.OnStateChange(hook)
+	}
+}
+
+// Call the hook after every proxied request, when the response headers are available.
+// Hooks are called synchronously and must not block. Can also be called after Handler().
+func (proxy *IsolationProxy) AddRequestHook(hook func(RequestEvent)) {
+	proxy.hooksLock.Lock()
+	defer proxy.hooksLock.Unlock()
+	proxy.requestHooks = append(proxy.requestHooks, hook)
+}
+
+func (proxy *IsolationProxy) currentRequestHooks() []func(RequestEvent) {
+	proxy.hooksLock.Lock()
+	defer proxy.hooksLock.Unlock()
+	return proxy.requestHooks
+}
+
+type RequestEvent struct {
+	Service  string
+	Request  *http.Request
+	Endpoint *Endpoint // The last endpoint the request was forwarded to, nil if none
+	Status   int       // 0, if err is set
+	Duration time.Duration
+	Err      error
+}
+
+// Publish state change events and call the state hooks for all endpoints of the service
+func (proxy *IsolationProxy) observe(serviceName string) {
+	var endpoints EndpointCollection
+	if registered, err := proxy.Registry.Endpoints(serviceName); err == nil {
+		endpoints = append(endpoints, registered...)
+	}
+	config := proxy.Configure(serviceName)
+	for _, route := range config.Routes {
+		endpoints = append(endpoints, route.Endpoints...)
+	}
+	// The state of shadow endpoints is not changed by mirrored requests, see Shadow
+
+	proxy.hooksLock.Lock()
+	defer proxy.hooksLock.Unlock()
+	for _, endpoint := range endpoints {
+		if proxy.observed[endpoint] {
+			continue
+		}
+		proxy.observed[endpoint] = true
+		endpoint.OnStateChange(proxy.publishStateChange)
+		for _, hook := range proxy.stateHooks {
+			endpoint.OnStateChange(hook)
+		}
+		if config.Queue != nil {
+			endpoint.OnStateChange(config.Queue.stateChanged)
+		}
+	}
+}
+
+type requestTraceKey struct{}
+
+// Records the endpoint a request was forwarded to, for the request hooks
+type requestTrace struct {
+	endpoint *Endpoint
+}
+
+func traceEndpoint(req *http.Request, endpoint *Endpoint) {
+	if trace, ok := req.Context().Value(requestTraceKey{}).(*requestTrace); ok {
+		trace.endpoint = endpoint
+	}
+}
+
+func (director *Director) trace(req *http.Request) (*http.Response, error) {
+	hooks := director.proxy.currentRequestHooks()
+	if len(hooks) == 0 {
+		return director.withDeadline(req)
+	}
+	trace := new(requestTrace)
+	start := time.Now()
+	resp, err := director.withDeadline(req.WithContext(context.WithValue(req.Context(), requestTraceKey{}, trace)))
+	event := RequestEvent{
+		Service:  director.serviceName,
+		Request:  req,
+		Endpoint: trace.endpoint,
+		Duration: time.Now().Sub(start),
+		Err:      err,
+	}
+	if resp != nil {
+		event.Status = resp.StatusCode
+	}
+	for _, hook := range hooks {
+		hook(event)
+	}
+	return resp, err
+}
@@ -12,28 +12,55 @@ type Stats struct {
 	Load        int
 	AvgDuration string
 	Active      bool
+	Overloaded  bool `json:",omitempty"`
 	Errors      int
 
+	// Weight of an endpoint in its slow start window, see Endpoint.SlowStartWeight
+	SlowStart float64 `json:",omitempty"`
+
+	// Rates in the window requested in the stats query, if any
+	Window *RateStats `json:",omitempty"`
+
 	totalDuration time.Duration
 }
 
 type EndpointStats struct {
 	Stats
-	Endpoints map[string]Stats
+	Endpoints  map[string]Stats
+	Shadow     *ShadowStats                      `json:",omitempty"`
+	Routes     map[string]*RouteStats            `json:",omitempty"`
+	Versions   map[string]*VersionStats          `json:",omitempty"`
+	Hashing    *HashStats                        `json:",omitempty"`
+	Locality   *LocalityStats                    `json:",omitempty"`
+	TcpClients map[string]*TcpClientStats        `json:",omitempty"`
+	Limits     *SanitizerStats                   `json:",omitempty"`
+	Shedding   map[Criticality]*CriticalityStats `json:",omitempty"`
+	Queue      *QueueStats                       `json:",omitempty"`
 }
 
 type ProxyStats map[string]*EndpointStats
 
+// Serve the cumulative statistics. The optional window query parameter
+// (e.g. ?window=60s) adds the rates in that time window, see RecordHistory().
 func (proxy *IsolationProxy) HandleStats() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		window, ok := parseWindow(w, r)
+		if !ok {
+			return
+		}
 		stats := proxy.Stats()
+		if window > 0 {
+			proxy.fillWindow(stats, window)
+		}
 		services.Http_respond_json(w, r, stats)
 		return
 	})
 }
 
+// Serve the statistics on the pattern and their history on pattern + "/history"
 func (proxy *IsolationProxy) ServeStats(pattern string) {
 	http.Handle(pattern, proxy.HandleStats())
+	http.Handle(pattern+"/history", proxy.HandleHistory())
 }
 
 func (proxy *IsolationProxy) Stats() ProxyStats {
@@ -46,25 +73,69 @@ func (proxy *IsolationProxy) Stats() ProxyStats {
 		if err != nil {
 			continue
 		}
-		for _, endpoint := range endpoints {
-			stats.fillFrom(endpoint)
+		for _, endpoint := range proxy.serviceEndpoints(service, endpoints) {
+			snapshot := endpoint.Snapshot()
+			stats.fillFrom(snapshot)
 			eStats := Stats{}
-			eStats.fillFrom(endpoint)
+			eStats.fillFrom(snapshot)
 			eStats.compute()
+			if weight := endpoint.SlowStartWeight(); weight < 1 && snapshot.Active {
+				eStats.SlowStart = weight
+			}
 			stats.Endpoints[endpoint.Name()] = eStats
 		}
 		stats.compute()
+		if config := proxy.existingConfig(service); config != nil {
+			stats.fillConfig(config, endpoints)
+		}
 		result[service] = stats
 	}
 	return result
 }
 
-func (stats *Stats) fillFrom(endpoint *Endpoint) {
-	stats.Requests += endpoint.Reqs()
-	stats.Load += endpoint.Load()
-	stats.totalDuration += endpoint.totalDuration
-	stats.Active = stats.Active || endpoint.Active()
-	stats.Errors += endpoint.Errors()
+func (stats *EndpointStats) fillConfig(config *ServiceConfig, endpoints EndpointCollection) {
+	if config.Shadow != nil {
+		stats.Shadow = config.Shadow.Stats()
+	}
+	if len(config.Routes) > 0 {
+		stats.Routes = make(map[string]*RouteStats)
+		for _, route := range config.Routes {
+			stats.Routes[route.Name] = route.Stats()
+		}
+	}
+	if config.Split != nil {
+		stats.Versions = config.Split.Stats(endpoints)
+	}
+	if config.Hash != nil {
+		stats.Hashing = config.Hash.Stats()
+	}
+	if config.Locality != nil {
+		stats.Locality = config.Locality.Stats()
+	}
+	if len(config.TcpClients) > 0 {
+		stats.TcpClients = make(map[string]*TcpClientStats)
+		for _, client := range config.TcpClients {
+			stats.TcpClients[client.Name] = client.Stats()
+		}
+	}
+	if config.Sanitizer != nil {
+		stats.Limits = config.Sanitizer.Stats()
+	}
+	if config.Shedder != nil {
+		stats.Shedding = config.Shedder.Stats()
+	}
+	if config.Queue != nil {
+		stats.Queue = config.Queue.Stats()
+	}
+}
+
+func (stats *Stats) fillFrom(endpoint EndpointSnapshot) {
+	stats.Requests += endpoint.Requests
+	stats.Load += endpoint.Load
+	stats.totalDuration += endpoint.TotalDuration
+	stats.Active = stats.Active || endpoint.Active
+	stats.Overloaded = stats.Overloaded || endpoint.Overloaded
+	stats.Errors += endpoint.Errors
 }
 
 func (stats *Stats) compute() {
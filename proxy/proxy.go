@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"sync"
 	"time"
 
 	"github.com/antongulenko/http-isolation-proxy/services"
@@ -13,59 +14,235 @@ import (
 var (
 	noActiveEndpointsErr   = errors.New("No active endpoints")
 	emergency_wait_timeout = 2 * time.Second
+
+	logger = services.Component("proxy")
 )
 
 type IsolationProxy struct {
-	Registry  Registry
-	transport *http.Transport
+	Registry     Registry
+	Zone         string // Zone of the proxy itself, see Locality
+	dialTimeout  time.Duration
+	trustedPeers []*net.IPNet // See WithTrustedPeers
+	transport    *http.Transport
+	dialer       *net.Dialer
+	configs      map[string]*ServiceConfig
+	configLock   sync.Mutex
+	clock        Clock
+
+	hooksLock    sync.Mutex // Protects the hooks and observed
+	stateHooks   []func(StateChange)
+	requestHooks []func(RequestEvent)
+	observed     map[*Endpoint]bool
+	events       *eventStream
+	history      statsHistory
+
+	stop     chan struct{} // Closed by Close()
+	stopOnce sync.Once
+}
+
+// Optional settings for one service. Must be configured before calling Handle() or Handler().
+type ServiceConfig struct {
+	Shadow *Shadow
+
+	// Checked in order, requests not matching any route go to all endpoints of the service
+	Routes []*Route
+
+	Split    *VersionSplit
+	Locality *Locality
+	Hash     *ConsistentHash
+
+	// Deadline for requests not carrying an earlier one in the services.DeadlineHeader
+	Timeout time.Duration
+
+	// Passed to httputil.ReverseProxy: flush streamed responses to the client
+	// in this interval. Negative values flush after every write.
+	FlushInterval time.Duration
+
+	// Clients of a non-HTTP service, see HandleTcp()
+	TcpClients []*TcpClient
+
+	Sanitizer *Sanitizer
+
+	// Reject less critical requests first when endpoints approach their load limit
+	Shedder *LoadShedder
+
+	// Wait for capacity in this queue when no endpoint is available
+	Queue *RequestQueue
 }
 
 func NewIsolationProxy(registry Registry, dialTimeout time.Duration) *IsolationProxy {
-	return &IsolationProxy{
-		Registry: registry,
-		// Based on http.DefaultTransport
-		transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   dialTimeout,
-				KeepAlive: dialTimeout,
-			}).Dial,
-			TLSHandshakeTimeout: dialTimeout,
-		},
+	return NewIsolationProxyWithOptions(WithRegistry(registry), WithDialTimeout(dialTimeout))
+}
+
+// The options replace the defaults of NewIsolationProxy(), see Option
+func NewIsolationProxyWithOptions(opts ...Option) *IsolationProxy {
+	proxy := &IsolationProxy{
+		Registry:    make(LocalRegistry),
+		dialTimeout: default_dial_timeout,
+		clock:       systemClock{},
+		configs:     make(map[string]*ServiceConfig),
+		observed:    make(map[*Endpoint]bool),
+		events:      newEventStream(),
+		stop:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(proxy)
+	}
+	proxy.dialer = &net.Dialer{
+		Timeout:   proxy.dialTimeout,
+		KeepAlive: proxy.dialTimeout,
+	}
+	// Based on http.DefaultTransport
+	proxy.transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		Dial:                proxy.dialer.Dial,
+		TLSHandshakeTimeout: proxy.dialTimeout,
+	}
+	return proxy
+}
+
+// Stop the background tasks of the proxy, see RecordHistory(). Handlers keep working.
+func (proxy *IsolationProxy) Close() {
+	proxy.stopOnce.Do(func() {
+		close(proxy.stop)
+	})
+}
+
+// Return the settings for the given service, create them if necessary
+func (proxy *IsolationProxy) Configure(serviceName string) *ServiceConfig {
+	proxy.configLock.Lock()
+	defer proxy.configLock.Unlock()
+	config, ok := proxy.configs[serviceName]
+	if !ok {
+		config = new(ServiceConfig)
+		proxy.configs[serviceName] = config
+	}
+	return config
+}
+
+// Return the settings for the given service, or nil
+func (proxy *IsolationProxy) existingConfig(serviceName string) *ServiceConfig {
+	proxy.configLock.Lock()
+	defer proxy.configLock.Unlock()
+	return proxy.configs[serviceName]
+}
+
+// The endpoints of the service in the registry, followed by the endpoints only used by its routes
+func (proxy *IsolationProxy) serviceEndpoints(serviceName string, registered EndpointCollection) EndpointCollection {
+	config := proxy.existingConfig(serviceName)
+	if config == nil || len(config.Routes) == 0 {
+		return registered
+	}
+	known := make(map[*Endpoint]bool, len(registered))
+	result := append(EndpointCollection(nil), registered...)
+	for _, endpoint := range registered {
+		known[endpoint] = true
+	}
+	for _, route := range config.Routes {
+		for _, endpoint := range route.Endpoints {
+			if !known[endpoint] {
+				known[endpoint] = true
+				result = append(result, endpoint)
+			}
+		}
 	}
+	return result
 }
 
 type Director struct {
 	proxy       *IsolationProxy
 	transport   *http.Transport
 	serviceName string
+	config      *ServiceConfig
 }
 
+// Serve the service on the given local address
 func (proxy *IsolationProxy) Handle(serviceName, localEndpoint string) error {
+	return http.ListenAndServe(localEndpoint, proxy.Handler(serviceName))
+}
+
+// Return a handler forwarding all requests to the service, to be served by the caller
+func (proxy *IsolationProxy) Handler(serviceName string) http.Handler {
 	director := &Director{
 		proxy:       proxy,
 		serviceName: serviceName,
+		config:      proxy.Configure(serviceName),
+	}
+	proxy.observe(serviceName)
+	if split := director.config.Split; split != nil && split.Canary != "" && !proxy.history.recording() {
+		logger.Warnf("Canary of %v is only checked after RecordHistory()", serviceName)
 	}
-	p := &httputil.ReverseProxy{
-		Director:  director.direct,
-		Transport: director,
+	return &httputil.ReverseProxy{
+		Director:      director.direct,
+		Transport:     director,
+		FlushInterval: director.config.FlushInterval,
 	}
-	return http.ListenAndServe(localEndpoint, p)
 }
 
 func (director *Director) direct(req *http.Request) {
 	if req.URL.Scheme == "" {
 		req.URL.Scheme = "http"
 	}
-	// Don't do anything here since we also define the RoundTripper
+	if sanitizer := director.config.Sanitizer; sanitizer != nil {
+		sanitizer.stripRequest(req)
+	}
+	if !director.proxy.trustedPeer(req) {
+		// Only a Route or a trusted peer can make a request more critical
+		req.Header.Del(CriticalityHeader)
+	}
+	// Everything else is done in the RoundTripper
+}
+
+func (director *Director) endpoints(route *Route) (EndpointCollection, error) {
+	if route != nil {
+		return route.Endpoints, nil
+	}
+	return director.proxy.Registry.Endpoints(director.serviceName)
+}
+
+// All endpoints of the service, including those only used by routes
+func (director *Director) allEndpoints() EndpointCollection {
+	registered, err := director.proxy.Registry.Endpoints(director.serviceName)
+	if err != nil {
+		registered = nil
+	}
+	return director.proxy.serviceEndpoints(director.serviceName, registered)
 }
 
-func (director *Director) endpointFor(req *http.Request) (*Endpoint, error) {
-	endpoints, err := director.proxy.Registry.Endpoints(director.serviceName)
+func (director *Director) endpointFor(req *http.Request, route *Route) (*Endpoint, error) {
+	endpoints, err := director.endpoints(route)
 	if err == nil {
-		endpoint := endpoints.Get()
+		if split := director.config.Split; split != nil {
+			endpoints = split.choose(req, endpoints)
+		}
+		if locality := director.config.Locality; locality != nil {
+			endpoints = locality.filter(endpoints, director.proxy.Zone)
+		}
+		queue := director.config.Queue
+		pick := func() *Endpoint {
+			available := endpoints
+			if queue != nil {
+				available = queue.available(endpoints)
+			}
+			if hash := director.config.Hash; hash != nil {
+				if endpoint := hash.get(req, director.allEndpoints(), available); endpoint != nil {
+					return endpoint
+				}
+			}
+			return available.Get()
+		}
+		var endpoint *Endpoint
+		if queue == nil || queue.empty() {
+			endpoint = pick()
+		}
 		if endpoint == nil {
-			endpoint = director.emergencyEndpoint(endpoints)
+			if queue == nil {
+				endpoint = emergencyEndpoint(director.proxy.clock, endpoints)
+			} else if endpoint, err = queue.wait(req.Context(), director.proxy.clock, pick); err == queueTimeoutErr {
+				endpoint = endpoints.EmergencyGet()
+			} else if err != nil {
+				return nil, err
+			}
 		}
 		if endpoint != nil {
 			return endpoint, nil
@@ -75,7 +252,8 @@ func (director *Director) endpointFor(req *http.Request) (*Endpoint, error) {
 	return nil, err
 }
 
-func (director *Director) emergencyEndpoint(endpoints EndpointCollection) *Endpoint {
+// Wait for one of the endpoints to become active, fall back to EmergencyGet() after a timeout
+func emergencyEndpoint(clock Clock, endpoints EndpointCollection) *Endpoint {
 	// TODO all this is a huge overhead just to wait for one of the endpoints to become active
 	endpointChan := make(chan *Endpoint, len(endpoints))
 	for _, endpoint := range endpoints {
@@ -84,13 +262,13 @@ func (director *Director) emergencyEndpoint(endpoints EndpointCollection) *Endpo
 			select {
 			case <-endpoint.WaitActive():
 				endpointChan <- endpoint
-			case <-time.After(emergency_wait_timeout):
+			case <-clock.After(emergency_wait_timeout):
 				return
 			}
 		}(endpoint)
 	}
 	select {
-	case <-time.After(emergency_wait_timeout):
+	case <-clock.After(emergency_wait_timeout):
 		return endpoints.EmergencyGet()
 	case endpoint := <-endpointChan:
 		return endpoint
@@ -102,21 +280,168 @@ func (director *Director) serviceUnavailable(req *http.Request) *http.Response {
 		"No server available to handle your request\n")
 }
 
+func (director *Director) overloaded(req *http.Request) *http.Response {
+	return services.MakeHttpResponse(req, http.StatusServiceUnavailable,
+		"Server overloaded, please retry later\n")
+}
+
+func (director *Director) deadlineExceeded(req *http.Request) *http.Response {
+	return services.MakeHttpResponse(req, http.StatusGatewayTimeout,
+		"Request deadline exceeded\n")
+}
+
 func (director *Director) RoundTrip(req *http.Request) (*http.Response, error) {
-	if endpoint, err := director.endpointFor(req); err != nil {
-		services.L.Logf("Cannot forward %s request for %s: %v", director.serviceName, req.URL.Path, err)
+	return director.trace(req)
+}
+
+// The deadline of the request in the time of the proxy clock, if any
+func (director *Director) deadline(req *http.Request) (time.Time, bool) {
+	now := director.proxy.clock.Now()
+	deadline, ok := services.RequestDeadline(req)
+	if ok {
+		deadline = now.Add(deadline.Sub(time.Now()))
+	}
+	if timeout := director.config.Timeout; timeout > 0 {
+		if limit := now.Add(timeout); !ok || limit.Before(deadline) {
+			deadline, ok = limit, true
+		}
+	}
+	return deadline, ok
+}
+
+// The deadline applies until the response body is consumed, except for upgraded
+// connections and streamed responses, where it only applies until the response headers arrive
+func (director *Director) withDeadline(req *http.Request) (*http.Response, error) {
+	deadline, ok := director.deadline(req)
+	if !ok {
+		return director.sanitize(req)
+	}
+	if !deadline.After(director.proxy.clock.Now()) {
+		logger.Logf("Rejecting %s request for %s: deadline exceeded", director.serviceName, req.URL.Path)
+		return director.deadlineExceeded(req), nil
+	}
+	ctx := withRequestDeadline(req.Context(), director.proxy.clock, deadline)
+	resp, err := director.sanitize(req.WithContext(ctx))
+	if err == nil && resp.Body != nil {
+		if isStreaming(resp, director.config.FlushInterval) {
+			ctx.lift()
+		}
+		resp.Body = trackBody(resp.Body, ctx.finish)
+	} else {
+		ctx.finish()
+	}
+	return resp, err
+}
+
+func (director *Director) sanitize(req *http.Request) (*http.Response, error) {
+	sanitizer := director.config.Sanitizer
+	if sanitizer == nil {
+		return director.mirror(req)
+	}
+	if resp := sanitizer.checkRequest(req); resp != nil {
+		logger.Logf("Rejecting %s request for %s: %v", director.serviceName, req.URL.Path, resp.Status)
+		return resp, nil
+	}
+	sanitizer.rewriteRequest(req, director.serviceName)
+	resp, err := director.mirror(req)
+	if err == nil {
+		sanitizer.rewriteResponse(resp)
+	}
+	return resp, err
+}
+
+func (director *Director) mirror(req *http.Request) (*http.Response, error) {
+	shadow := director.config.Shadow
+	if shadow == nil || isUpgrade(req) || !shadow.sample() || !shadow.acquire() {
+		return director.forward(req)
+	}
+	body, buffered, err := bufferLimitedBody(req, shadow.maxBodySize())
+	if err != nil {
+		shadow.release()
+		logger.Logf("Failed to read %s request body for %s: %v", director.serviceName, req.URL.Path, err)
+		return services.MakeHttpResponse(req, http.StatusBadRequest, "Failed to read request body\n"), nil
+	}
+	if !buffered {
+		shadow.drop()
+		logger.Tracef("Not mirroring %s request for %s: body too large", director.serviceName, req.URL.Path)
+		return director.forward(req)
+	}
+	shadowReq := copyRequest(req, body)
+	start := time.Now()
+	resp, err := director.forward(req)
+	if err == nil {
+		go shadow.mirror(shadowReq, resp.StatusCode, time.Now().Sub(start))
+	} else {
+		shadow.release()
+	}
+	return resp, err
+}
+
+func (director *Director) forward(req *http.Request) (*http.Response, error) {
+	route := director.config.route(req)
+	if route != nil {
+		logger.Tracef("%s request for %s matches route %s", director.serviceName, req.URL.Path, route.Name)
+	}
+	return director.forwardTo(req, route, requestCriticality(req, route))
+}
+
+// The endpoint handed out by the queue was not used, let the next request in the queue try it
+func (director *Director) dispatchQueued() {
+	if queue := director.config.Queue; queue != nil {
+		queue.dispatch()
+	}
+}
+
+func (director *Director) forwardTo(req *http.Request, route *Route, criticality Criticality) (*http.Response, error) {
+	if endpoint, err := director.endpointFor(req, route); err == requestAbortedErr {
+		logger.Logf("Aborted waiting for %s endpoint for %s: %v", director.serviceName, req.URL.Path, req.Context().Err())
+		return director.deadlineExceeded(req), nil
+	} else if err == queueTooLateErr {
+		logger.Logf("Rejecting %s request for %s: %v", director.serviceName, req.URL.Path, err)
+		return director.deadlineExceeded(req), nil
+	} else if err != nil {
+		logger.Logf("Cannot forward %s request for %s: %v", director.serviceName, req.URL.Path, err)
 		return director.serviceUnavailable(req), nil
 	} else {
-		services.L.Logf("Forwarding %s to %v for %s", director.serviceName, endpoint, req.URL.Path)
+		if shedder := director.config.Shedder; shedder != nil && !shedder.admit(endpoint, criticality) {
+			logger.Warnf("Shedding %s %s request for %s: %v is overloaded", criticality, director.serviceName, req.URL.Path, endpoint)
+			director.dispatchQueued()
+			return director.overloaded(req), nil
+		}
+		// Pass on the remaining budget, including the time spent in the proxy
+		if deadline, ok := req.Context().Deadline(); ok && !services.SetDeadlineHeader(req.Header, deadline) {
+			logger.Logf("Not forwarding %s request for %s: deadline exceeded", director.serviceName, req.URL.Path)
+			director.dispatchQueued()
+			return director.deadlineExceeded(req), nil
+		}
+		logger.Logf("Forwarding %s to %v for %s", director.serviceName, endpoint, req.URL.Path)
+		traceEndpoint(req, endpoint)
 		endpoint.ConfigureUrl(req.URL)
-		var resp *http.Response
-		endpoint.RoundTrip(func() error {
-			resp, err = director.proxy.transport.RoundTrip(req)
-			return err
+		resp, err := endpoint.StreamingRoundTrip(func() (*http.Response, error) {
+			resp, err := director.proxy.transport.RoundTrip(req)
+			if err != nil && req.Context().Err() != nil {
+				return nil, requestAbortedErr
+			}
+			return resp, err
 		})
+		if queue := director.config.Queue; queue != nil {
+			// The load of the endpoint is released with the response body, see StreamingRoundTrip
+			if err == nil {
+				resp.Body = trackBody(resp.Body, queue.dispatch)
+			} else {
+				queue.dispatch()
+			}
+		}
+		if err == requestAbortedErr {
+			logger.Logf("Aborted forwarding %s to %v for %s: %v", director.serviceName, endpoint, req.URL.Path, req.Context().Err())
+			return director.deadlineExceeded(req), nil
+		}
 		if err != nil {
-			services.L.Warnf("Error forwarding %s to %v for %s: %v. Will try other endpoint...", director.serviceName, endpoint, req.URL.Path, err)
-			return director.RoundTrip(req) // Should pick a different endpoint
+			logger.Warnf("Error forwarding %s to %v for %s: %v. Will try other endpoint...", director.serviceName, endpoint, req.URL.Path, err)
+			return director.forwardTo(req, route, criticality) // Should pick a different endpoint
+		}
+		if split := director.config.Split; split != nil {
+			split.pin(req, resp, endpoint)
 		}
 		return resp, err
 	}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("ok"))
+})
+
+// Closes the connection without responding
+var failingHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		_ = conn.Close()
+	}
+})
+
+func newTestDirector(clock Clock, endpoints ...*Endpoint) *Director {
+	registry := make(LocalRegistry)
+	for _, endpoint := range endpoints {
+		registry.Add("svc", endpoint)
+	}
+	p := NewIsolationProxyWithOptions(WithRegistry(registry), WithClock(clock))
+	return &Director{proxy: p, serviceName: "svc", config: p.Configure("svc")}
+}
+
+// Return the status and body of the response. Can be called from other goroutines,
+// so errors do not stop the test.
+func roundTrip(t *testing.T, director *Director) (int, string) {
+	req, err := http.NewRequest("GET", "http://svc/path", nil)
+	if err != nil {
+		t.Error(err)
+		return 0, ""
+	}
+	director.direct(req)
+	resp, err := director.RoundTrip(req)
+	if err != nil {
+		t.Error(err)
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestRoundTripForwards(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+	endpoint := NewEndpoint("svc", hostOf(backend))
+	director := newTestDirector(newFakeClock(), endpoint)
+
+	if status, body := roundTrip(t, director); status != http.StatusOK || body != "/path" {
+		t.Errorf("Unexpected response %v: %v", status, body)
+	}
+	if snapshot := endpoint.Snapshot(); snapshot.Requests != 1 || snapshot.Load != 0 {
+		t.Errorf("Unexpected endpoint state: %+v", snapshot)
+	}
+}
+
+func TestRoundTripRetriesOtherEndpoint(t *testing.T) {
+	failingBackend := httptest.NewServer(failingHandler)
+	defer failingBackend.Close()
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+	failing := NewEndpoint("svc", hostOf(failingBackend), WithEndpointClock(newFakeClock()))
+	healthy := NewEndpoint("svc", hostOf(backend))
+	director := newTestDirector(newFakeClock(), failing, healthy) // The failing endpoint is tried first
+
+	if status, body := roundTrip(t, director); status != http.StatusOK || body != "ok" {
+		t.Errorf("Unexpected response %v: %v", status, body)
+	}
+	if snapshot := failing.Snapshot(); snapshot.Active || snapshot.Errors != 1 {
+		t.Errorf("Unexpected state of failing endpoint: %+v", snapshot)
+	}
+}
+
+func TestRoundTripWithoutEndpoints(t *testing.T) {
+	director := newTestDirector(newFakeClock())
+	if status, _ := roundTrip(t, director); status != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status %v", status)
+	}
+}
+
+func TestRoundTripAllInactive(t *testing.T) {
+	clock := newFakeClock()
+	endpoint := NewEndpoint("svc", freeAddress(t), WithEndpointClock(newFakeClock()))
+	director := newTestDirector(clock, endpoint)
+
+	status := make(chan int)
+	go func() {
+		code, _ := roundTrip(t, director)
+		status <- code
+	}()
+	clock.BlockUntil(t, 2) // Waiting for the endpoint, and for the timeout
+	clock.Advance(emergency_wait_timeout)
+	if code := <-status; code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status %v", code)
+	}
+}
+
+func TestRoundTripWaitsForRecovery(t *testing.T) {
+	clock, endpointClock := newFakeClock(), newFakeClock()
+	addr := freeAddress(t)
+	endpoint := NewEndpoint("svc", addr, WithEndpointClock(endpointClock))
+	director := newTestDirector(clock, endpoint)
+
+	status := make(chan int)
+	go func() {
+		code, _ := roundTrip(t, director)
+		status <- code
+	}()
+	clock.BlockUntil(t, 2)
+	listener := listen(t, addr)
+	defer listener.Close()
+	go func() {
+		_ = http.Serve(listener, okHandler)
+	}()
+	endpointClock.BlockUntil(t, 1)
+	endpointClock.Advance(online_check_interval)
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("Unexpected status %v", code)
+	}
+}
+
+func TestRoundTripSlowBackendOverloads(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		_, _ = w.Write([]byte("slow"))
+	}))
+	defer backend.Close()
+	clock := newFakeClock()
+	endpoint := NewEndpoint("svc", hostOf(backend), WithEndpointClock(clock))
+	director := newTestDirector(newFakeClock(), endpoint)
+
+	status := make(chan int)
+	go func() {
+		code, _ := roundTrip(t, director)
+		status <- code
+	}()
+	<-received
+	clock.Advance(overload_request_duration + 1)
+	close(release)
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("Unexpected status %v", code)
+	}
+	if !endpoint.Overloaded() {
+		t.Errorf("Slow %v not overloaded", endpoint)
+	}
+}
+
+func TestHooksAddedAfterHandler(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+	endpoint := NewEndpoint("svc", hostOf(backend), WithEndpointClock(newFakeClock()))
+	registry := make(LocalRegistry)
+	registry.Add("svc", endpoint)
+	p := NewIsolationProxy(registry, default_dial_timeout)
+	director := &Director{proxy: p, serviceName: "svc", config: p.Configure("svc")}
+	p.Handler("svc")
+
+	changes := make(chan StateChange, 1)
+	p.AddStateHook(func(change StateChange) { changes <- change })
+	requests := make(chan RequestEvent, 1)
+	p.AddRequestHook(func(event RequestEvent) { requests <- event })
+	if code, _ := roundTrip(t, director); code != http.StatusOK {
+		t.Errorf("Unexpected status %v", code)
+	}
+	if len(requests) != 1 {
+		t.Errorf("Request hook not called")
+	}
+	for i := 0; i < 5; i++ {
+		endpoint.RoundTrip(func() error { return errors.New("failure") })
+	}
+	if len(changes) != 1 {
+		t.Errorf("State hook not called")
+	}
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type QueueOrder string
+
+const (
+	// Serve the request that waited longest first
+	QueueFifo = QueueOrder("fifo")
+
+	// Serve the newest request first. Keeps the latency of most requests low
+	// under overload, while the oldest ones time out.
+	QueueLifo = QueueOrder("lifo")
+
+	// Serve the request with the earliest deadline first. Requests whose deadline ends
+	// before the average wait in the queue are rejected right away.
+	QueueDeadline = QueueOrder("deadline")
+)
+
+const default_queue_max_wait = 2 * time.Second
+
+var (
+	queueFullErr    = errors.New("Request queue is full")
+	queueTimeoutErr = errors.New("Timed out waiting in request queue")
+	queueTooLateErr = errors.New("Request deadline ends before the expected wait in request queue")
+)
+
+func ParseQueueOrder(order string) (QueueOrder, error) {
+	switch result := QueueOrder(order); result {
+	case "":
+		return QueueFifo, nil
+	case QueueFifo, QueueLifo, QueueDeadline:
+		return result, nil
+	default:
+		return "", fmt.Errorf("Unknown queue order: %v", order)
+	}
+}
+
+// Holds requests while no endpoint of a service has capacity, and dispatches them when
+// a request finishes or an endpoint becomes active. Replaces waiting up to
+// emergency_wait_timeout for any endpoint to become active. Requests only skip the queue
+// if it is empty and an endpoint has capacity when they arrive. After MaxWait, requests
+// fall back to overloaded endpoints like without a queue.
+type RequestQueue struct {
+	Order   QueueOrder
+	MaxWait time.Duration // Unless the deadline of a request ends earlier, default_queue_max_wait if zero
+	MaxSize int           // Requests arriving at a full queue are rejected, no limit if zero
+	MaxLoad int           // Endpoints with this load have no capacity, no limit if zero
+
+	lock       sync.Mutex
+	waiting    []*queuedRequest // Sorted by before()
+	queued     uint
+	dispatched uint
+	rejected   uint
+	expired    uint
+	totalWait  time.Duration
+	longest    time.Duration
+
+	dispatchedWait time.Duration // Part of totalWait spent by dispatched requests
+}
+
+type QueueStats struct {
+	Order      QueueOrder
+	Depth      int
+	Queued     uint
+	Dispatched uint
+	Rejected   uint
+	Expired    uint // Including requests aborted while waiting
+	AvgWait    string
+	MaxWait    string
+}
+
+type queuedRequest struct {
+	arrival  time.Time
+	deadline time.Time     // Of the request, at most MaxWait after the arrival
+	queued   bool          // Protected by RequestQueue.lock
+	ready    chan struct{} // Signalled when removed from the queue by dispatch()
+}
+
+func (queue *RequestQueue) maxWait() time.Duration {
+	if queue.MaxWait > 0 {
+		return queue.MaxWait
+	}
+	return default_queue_max_wait
+}
+
+// The endpoints with capacity for another request
+func (queue *RequestQueue) available(endpoints EndpointCollection) EndpointCollection {
+	if queue.MaxLoad <= 0 {
+		return endpoints
+	}
+	result := make(EndpointCollection, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if endpoint.Load() < queue.MaxLoad {
+			result = append(result, endpoint)
+		}
+	}
+	return result
+}
+
+// Whether requests are waiting. New requests must enter the queue in that case.
+func (queue *RequestQueue) empty() bool {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.waiting) == 0
+}
+
+// Wait in the queue until pick() returns an endpoint. pick() is called when the
+// request is the next one in the queue and capacity might have become available.
+func (queue *RequestQueue) wait(ctx context.Context, clock Clock, pick func() *Endpoint) (*Endpoint, error) {
+	now := clock.Now()
+	request := &queuedRequest{
+		arrival:  now,
+		deadline: now.Add(queue.maxWait()),
+		ready:    make(chan struct{}, 1),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// The context deadline is in the system time, see requestDeadline
+		if deadline := now.Add(time.Until(deadline)); deadline.Before(request.deadline) {
+			request.deadline = deadline
+		}
+	}
+	next, err := queue.enqueue(request)
+	if err != nil {
+		return nil, err
+	}
+	timeout := clock.After(queue.maxWait())
+	for {
+		// Check after enqueueing, so that capacity freed in between is not missed
+		if next {
+			if endpoint := pick(); endpoint != nil {
+				queue.leave(request, clock.Now(), true)
+				return endpoint, nil
+			}
+		}
+		select {
+		case <-request.ready:
+			queue.requeue(request)
+			next = true
+		case <-timeout:
+			queue.leave(request, clock.Now(), false)
+			return nil, queueTimeoutErr
+		case <-ctx.Done():
+			queue.leave(request, clock.Now(), false)
+			return nil, requestAbortedErr
+		}
+	}
+}
+
+// Add the request to the queue, return whether it is the next one to be dispatched
+func (queue *RequestQueue) enqueue(request *queuedRequest) (bool, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.MaxSize > 0 && len(queue.waiting) >= queue.MaxSize {
+		queue.rejected++
+		return false, queueFullErr
+	}
+	if queue.Order == QueueDeadline && queue.dispatched > 0 {
+		avgWait := queue.dispatchedWait / time.Duration(queue.dispatched)
+		if request.deadline.Sub(request.arrival) < avgWait {
+			queue.rejected++
+			return false, queueTooLateErr
+		}
+	}
+	queue.queued++
+	queue.insertLocked(request)
+	if queue.Order == QueueLifo {
+		return queue.waiting[len(queue.waiting)-1] == request, nil
+	}
+	return queue.waiting[0] == request, nil
+}
+
+// Put a request back in its place after it was dispatched without finding capacity
+func (queue *RequestQueue) requeue(request *queuedRequest) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if !request.queued {
+		queue.insertLocked(request)
+	}
+}
+
+// Whether the request is sorted before the other one in the waiting requests
+func (queue *RequestQueue) before(request, other *queuedRequest) bool {
+	if queue.Order == QueueDeadline {
+		return request.deadline.Before(other.deadline)
+	}
+	return request.arrival.Before(other.arrival)
+}
+
+func (queue *RequestQueue) insertLocked(request *queuedRequest) {
+	i := len(queue.waiting)
+	for i > 0 && queue.before(request, queue.waiting[i-1]) {
+		i--
+	}
+	queue.waiting = append(queue.waiting, nil)
+	copy(queue.waiting[i+1:], queue.waiting[i:])
+	queue.waiting[i] = request
+	request.queued = true
+}
+
+func (queue *RequestQueue) leave(request *queuedRequest, now time.Time, dispatched bool) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if dispatched {
+		queue.dispatched++
+		queue.dispatchedWait += now.Sub(request.arrival)
+	} else {
+		queue.expired++
+	}
+	wait := now.Sub(request.arrival)
+	queue.totalWait += wait
+	if wait > queue.longest {
+		queue.longest = wait
+	}
+	if !request.queued {
+		// Woken up without taking the capacity, pass it on to the next request.
+		// After taking it, the next request can check for more capacity.
+		queue.dispatchLocked()
+		return
+	}
+	request.queued = false
+	for i, waiting := range queue.waiting {
+		if waiting == request {
+			queue.waiting = append(queue.waiting[:i], queue.waiting[i+1:]...)
+			break
+		}
+	}
+}
+
+// Wake up the next waiting request, if any. Called when capacity might have become available.
+func (queue *RequestQueue) dispatch() {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	queue.dispatchLocked()
+}
+
+func (queue *RequestQueue) dispatchLocked() {
+	if len(queue.waiting) == 0 {
+		return
+	}
+	var request *queuedRequest
+	if queue.Order == QueueLifo {
+		request = queue.waiting[len(queue.waiting)-1]
+		queue.waiting = queue.waiting[:len(queue.waiting)-1]
+	} else {
+		request = queue.waiting[0]
+		queue.waiting = queue.waiting[1:]
+	}
+	request.queued = false
+	request.ready <- struct{}{}
+}
+
+func (queue *RequestQueue) stateChanged(StateChange) {
+	queue.dispatch()
+}
+
+func (queue *RequestQueue) Stats() *QueueStats {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	stats := &QueueStats{
+		Order:      queue.Order,
+		Depth:      len(queue.waiting),
+		Queued:     queue.queued,
+		Dispatched: queue.dispatched,
+		Rejected:   queue.rejected,
+		Expired:    queue.expired,
+		AvgWait:    "(no data)",
+		MaxWait:    queue.longest.String(),
+	}
+	if left := queue.dispatched + queue.expired; left > 0 {
+		stats.AvgWait = (queue.totalWait / time.Duration(left)).String()
+	}
+	return stats
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Hands out the endpoint once per call to add()
+type testCapacity struct {
+	lock     sync.Mutex
+	endpoint *Endpoint
+	slots    int
+}
+
+func (capacity *testCapacity) add() {
+	capacity.lock.Lock()
+	defer capacity.lock.Unlock()
+	capacity.slots++
+}
+
+func (capacity *testCapacity) pick() *Endpoint {
+	capacity.lock.Lock()
+	defer capacity.lock.Unlock()
+	if capacity.slots == 0 {
+		return nil
+	}
+	capacity.slots--
+	return capacity.endpoint
+}
+
+func waitDepth(t *testing.T, queue *RequestQueue, depth int) {
+	eventually(t, "the queue has the expected depth", func() bool { return queue.Stats().Depth == depth })
+}
+
+func TestQueueDispatchOrder(t *testing.T) {
+	for order, expected := range map[QueueOrder][]int{
+		QueueFifo: {0, 1, 2},
+		QueueLifo: {2, 1, 0},
+	} {
+		queue := &RequestQueue{Order: order}
+		capacity := &testCapacity{endpoint: testEndpoint("a:1", state_active, 0, 0)}
+		done := make(chan int)
+		for i := 0; i < 3; i++ {
+			go func(i int) {
+				if _, err := queue.wait(context.Background(), newFakeClock(), capacity.pick); err != nil {
+					t.Error(err)
+				}
+				done <- i
+			}(i)
+			waitDepth(t, queue, i+1)
+		}
+		for _, next := range expected {
+			capacity.add()
+			queue.dispatch()
+			if got := <-done; got != next {
+				t.Errorf("%v queue dispatched request %v, expected %v", order, got, next)
+			}
+		}
+		if stats := queue.Stats(); stats.Depth != 0 || stats.Queued != 3 || stats.Dispatched != 3 {
+			t.Errorf("Unexpected %v queue stats: %+v", order, stats)
+		}
+	}
+}
+
+func TestQueueRejectsAndExpires(t *testing.T) {
+	clock := newFakeClock()
+	queue := &RequestQueue{MaxSize: 1, MaxWait: time.Second}
+	capacity := &testCapacity{}
+	result := make(chan error)
+	go func() {
+		_, err := queue.wait(context.Background(), clock, capacity.pick)
+		result <- err
+	}()
+	clock.BlockUntil(t, 1)
+	if _, err := queue.wait(context.Background(), clock, capacity.pick); err != queueFullErr {
+		t.Errorf("Unexpected error for full queue: %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := <-result; err != queueTimeoutErr {
+		t.Errorf("Unexpected error after max wait: %v", err)
+	}
+	if stats := queue.Stats(); stats.Depth != 0 || stats.Rejected != 1 || stats.Expired != 1 || stats.MaxWait != "1s" {
+		t.Errorf("Unexpected queue stats: %+v", stats)
+	}
+}
+
+func TestRoundTripQueuesForBusyEndpoint(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	director := newTestDirector(newFakeClock(), NewEndpoint("svc", hostOf(backend)))
+	queue := &RequestQueue{MaxLoad: 1}
+	director.config.Queue = queue
+
+	status := make(chan int)
+	send := func() {
+		code, _ := roundTrip(t, director)
+		status <- code
+	}
+	go send()
+	<-received
+	go send()
+	waitDepth(t, queue, 1)
+	release <- struct{}{}
+	<-received // The queued request reaches the backend after the first one finished
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if code := <-status; code != http.StatusOK {
+			t.Errorf("Unexpected status %v", code)
+		}
+	}
+	if stats := queue.Stats(); stats.Queued != 1 || stats.Dispatched != 1 {
+		t.Errorf("Unexpected queue stats: %+v", stats)
+	}
+}
+
+func TestRoundTripDispatchesAfterShedding(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	director := newTestDirector(newFakeClock(), NewEndpoint("svc", hostOf(backend)))
+	queue := &RequestQueue{MaxLoad: 1}
+	director.config.Queue = queue
+	director.config.Shedder = &LoadShedder{
+		MaxLoad:    1,
+		Thresholds: map[Criticality]float64{CriticalitySheddable: 0}, // Always shed
+	}
+	WithTrustedPeers(&net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)})(director.proxy)
+
+	status := make(chan int, 3)
+	send := func(criticality Criticality) {
+		req, err := http.NewRequest("GET", "http://svc/path", nil)
+		if err != nil {
+			t.Error(err)
+			status <- 0
+			return
+		}
+		req.Header.Set(CriticalityHeader, string(criticality))
+		req.RemoteAddr = "127.0.0.1:40000"
+		director.direct(req)
+		resp, err := director.RoundTrip(req)
+		if err != nil {
+			t.Error(err)
+			status <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		status <- resp.StatusCode
+	}
+	go send(CriticalityCritical)
+	<-received
+	go send(CriticalitySheddable)
+	waitDepth(t, queue, 1)
+	go send(CriticalityCritical)
+	waitDepth(t, queue, 2)
+
+	// The sheddable request gets the endpoint first, the critical one must follow
+	release <- struct{}{}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queued request was not dispatched after the request before it was shed")
+	}
+	release <- struct{}{}
+	codes := map[int]int{}
+	for i := 0; i < 3; i++ {
+		codes[<-status]++
+	}
+	if codes[http.StatusOK] != 2 || len(codes) != 2 {
+		t.Errorf("Unexpected status codes: %v", codes)
+	}
+}
+
+func TestQueueNotSkippedWhileWaiting(t *testing.T) {
+	queue := &RequestQueue{}
+	capacity := &testCapacity{endpoint: testEndpoint("a:1", state_active, 0, 0)}
+	done := make(chan int)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			if _, err := queue.wait(context.Background(), newFakeClock(), capacity.pick); err != nil {
+				t.Error(err)
+			}
+			done <- i
+		}(i)
+		waitDepth(t, queue, i+1)
+		// Capacity freed before dispatching must not be taken by the newer request
+		capacity.add()
+	}
+	for expected := 0; expected < 2; expected++ {
+		queue.dispatch()
+		if got := <-done; got != expected {
+			t.Errorf("Request %v dispatched, expected %v", got, expected)
+		}
+	}
+}
+
+func TestQueueDeadlineOrder(t *testing.T) {
+	clock := newFakeClock()
+	queue := &RequestQueue{Order: QueueDeadline, MaxWait: 10 * time.Second}
+	capacity := &testCapacity{endpoint: testEndpoint("a:1", state_active, 0, 0)}
+	done := make(chan int)
+	for i, timeout := range []time.Duration{3 * time.Second, time.Second, 2 * time.Second} {
+		go func(i int, timeout time.Duration) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if _, err := queue.wait(ctx, clock, capacity.pick); err != nil {
+				t.Error(err)
+			}
+			done <- i
+		}(i, timeout)
+		waitDepth(t, queue, i+1)
+	}
+	clock.Advance(500 * time.Millisecond)
+	for _, expected := range []int{1, 2, 0} {
+		capacity.add()
+		queue.dispatch()
+		if got := <-done; got != expected {
+			t.Errorf("Request %v dispatched, expected %v", got, expected)
+		}
+	}
+
+	// The deadline ends before the average wait of 500ms
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := queue.wait(ctx, clock, capacity.pick); err != queueTooLateErr {
+		t.Errorf("Unexpected error for request with short deadline: %v", err)
+	}
+	if stats := queue.Stats(); stats.Dispatched != 3 || stats.Rejected != 1 {
+		t.Errorf("Unexpected queue stats: %+v", stats)
+	}
+}
+
+func TestRoundTripFallsBackAfterMaxWait(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	clock := newFakeClock()
+	director := newTestDirector(clock, NewEndpoint("svc", hostOf(backend)))
+	queue := &RequestQueue{MaxLoad: 1, MaxWait: time.Second}
+	director.config.Queue = queue
+
+	status := make(chan int)
+	send := func() {
+		code, _ := roundTrip(t, director)
+		status <- code
+	}
+	go send()
+	<-received
+	go send()
+	waitDepth(t, queue, 1)
+	clock.BlockUntil(t, 1)
+	clock.Advance(time.Second)
+	<-received // Forwarded to the busy endpoint after waiting in the queue
+	release <- struct{}{}
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if code := <-status; code != http.StatusOK {
+			t.Errorf("Unexpected status %v", code)
+		}
+	}
+	if stats := queue.Stats(); stats.Queued != 1 || stats.Expired != 1 {
+		t.Errorf("Unexpected queue stats: %+v", stats)
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+// These tests are most useful with the race detector: go test -race ./proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	race_clients  = 10
+	race_requests = 50
+)
+
+// Every fifth request fails with a closed connection, which deactivates the endpoint
+// and starts its background check
+func newFlakyBackend() *httptest.Server {
+	var requests int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1)%5 == 0 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+		_, _ = w.Write([]byte("ok"))
+	}))
+}
+
+func hostOf(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// Run f in count goroutines and wait for them
+func parallel(count int, f func()) {
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentRoundTripAndStats(t *testing.T) {
+	backend := newFlakyBackend()
+	defer backend.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	registry := make(LocalRegistry)
+	flaky := NewEndpoint("svc", hostOf(backend), WithCheckInterval(time.Millisecond))
+	registry.Add("svc", flaky)
+	registry.Add("svc", NewEndpoint("svc", hostOf(closed), WithCheckInterval(time.Millisecond)))
+
+	var stateChanges, requests int32
+	p := NewIsolationProxyWithOptions(WithRegistry(registry),
+		OnStateChange(func(StateChange) { atomic.AddInt32(&stateChanges, 1) }),
+		OnRequest(func(RequestEvent) { atomic.AddInt32(&requests, 1) }))
+	p.Handler("svc") // Attaches the hooks
+	director := &Director{proxy: p, serviceName: "svc", config: p.Configure("svc")}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			stats := p.Stats()
+			p.fillWindow(stats, time.Minute)
+			p.history.add(p.snapshot())
+			_ = p.History(0)
+			_ = flaky.Snapshot()
+			_ = registry["svc"].Get()
+		}
+	}()
+
+	parallel(race_clients, func() {
+		for i := 0; i < race_requests; i++ {
+			req, err := http.NewRequest("GET", "http://svc/", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			director.direct(req)
+			resp, err := director.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, _ = ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+		}
+	})
+	close(done)
+	readers.Wait()
+
+	stats := p.Stats()["svc"]
+	if stats.Load != 0 {
+		t.Errorf("Load %v after all requests finished", stats.Load)
+	}
+	if stats.Errors == 0 || stats.Requests < race_clients*race_requests {
+		t.Errorf("Unexpected stats: %v requests, %v errors", stats.Requests, stats.Errors)
+	}
+	if got := atomic.LoadInt32(&requests); got != race_clients*race_requests {
+		t.Errorf("Request hook called %v times, expected %v", got, race_clients*race_requests)
+	}
+	if atomic.LoadInt32(&stateChanges) == 0 {
+		t.Error("State change hook was not called")
+	}
+}
+
+func TestConcurrentEndpointTransitions(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	defer backend.Close()
+	endpoint := NewEndpoint("svc", hostOf(backend), WithCheckInterval(time.Millisecond))
+	failure := errors.New("failure")
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-endpoint.WaitActive():
+			}
+			snapshot := endpoint.Snapshot()
+			if snapshot.Active && snapshot.Overloaded {
+				t.Error("Endpoint both active and overloaded")
+			}
+		}
+	}()
+	parallel(race_clients, func() {
+		for i := 0; i < race_requests; i++ {
+			var err error
+			if i%3 == 0 {
+				err = failure
+			}
+			endpoint.RoundTrip(func() error { return err })
+		}
+	})
+	close(done)
+
+	snapshot := endpoint.Snapshot()
+	if snapshot.Requests != race_clients*race_requests || snapshot.Load != 0 {
+		t.Errorf("Unexpected counters: %v requests, load %v", snapshot.Requests, snapshot.Load)
+	}
+	if expected := race_clients * ((race_requests + 2) / 3); snapshot.Errors != expected {
+		t.Errorf("%v errors, expected %v", snapshot.Errors, expected)
+	}
+}
@@ -10,39 +10,81 @@ type Registry interface {
 type EndpointCollection []*Endpoint
 
 func (col EndpointCollection) Get() *Endpoint {
-	// Linear "search" for small collections
-	var result *Endpoint
-	for _, endpoint := range col {
-		if endpoint.Active() {
-			// Balance based on current load and history of requests (round robin in low-load situations)
-			if result == nil || endpoint.Load() < result.Load() || endpoint.Reqs() < result.Reqs() {
-				result = endpoint
-			}
-		}
-	}
-	return result
+	return col.get((*Endpoint).Active)
 }
 
 func (col EndpointCollection) EmergencyGet() *Endpoint {
 	// Like Get(), but also include overloaded endpoints
 	// TODO whether this should be done depends on situation on endpoint and semantics of the call
-	var result *Endpoint
+	return col.get(func(endpoint *Endpoint) bool {
+		return endpoint.Active() || endpoint.Overloaded()
+	})
+}
+
+func (col EndpointCollection) get(usable func(*Endpoint) bool) *Endpoint {
+	candidates := make(EndpointCollection, 0, len(col))
 	for _, endpoint := range col {
-		if endpoint.Active() || endpoint.Overloaded() {
-			// Balance based on current load and history of requests (round robin in low-load situations)
-			if result == nil || endpoint.Load() < result.Load() || endpoint.Reqs() < result.Reqs() {
-				result = endpoint
-			}
+		if usable(endpoint) {
+			candidates = append(candidates, endpoint)
+		}
+	}
+
+	// Linear "search" for small collections
+	var result, ramping, skipped *Endpoint
+	for _, endpoint := range candidates {
+		weight := endpoint.SlowStartWeight()
+		switch {
+		case weight >= 1:
+			result = preferred(result, endpoint)
+		case skipSlowStart(weight, len(candidates)):
+			skipped = preferred(skipped, endpoint)
+		default:
+			ramping = preferred(ramping, endpoint)
 		}
 	}
+	if ramping != nil && (result == nil || preferred(ramping, result) == ramping) {
+		// Wins ties, it was only considered for its weighted share of the requests
+		result = ramping
+	}
+	if result == nil {
+		// Only endpoints in their slow start window left
+		result = skipped
+	}
+	return result
+}
+
+// Balance based on current load and history of requests (round robin in low-load situations)
+func preferred(result, endpoint *Endpoint) *Endpoint {
+	if result == nil {
+		return endpoint
+	}
+	load, reqs := endpoint.balance()
+	resultLoad, resultReqs := result.balance()
+	if load < resultLoad || reqs < resultReqs {
+		return endpoint
+	}
 	return result
 }
 
 // Alternative implementation would use a centralized registry server
 type LocalRegistry map[string]EndpointCollection
 
+// The endpoint is rebased to the other endpoints of the service after becoming active again
 func (reg LocalRegistry) Add(serviceName string, endpoint *Endpoint) {
 	reg[serviceName] = append(reg[serviceName], endpoint)
+	endpoint.lock.Lock()
+	endpoint.siblings = func() EndpointCollection { return reg[serviceName] }
+	endpoint.lock.Unlock()
+}
+
+// Return the endpoint of the given service with the given host, or nil
+func (reg LocalRegistry) Find(serviceName string, host string) *Endpoint {
+	for _, endpoint := range reg[serviceName] {
+		if endpoint.Host == host {
+			return endpoint
+		}
+	}
+	return nil
 }
 
 func (reg LocalRegistry) Endpoints(serviceName string) (endpoints EndpointCollection, err error) {
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+// An endpoint in the given state, without checking its connection
+func testEndpoint(host string, state int32, load int, reqs uint) *Endpoint {
+	return &Endpoint{
+		Service:  "svc",
+		Host:     host,
+		state:    state,
+		load:     load,
+		reqs:     reqs,
+		balanced: reqs,
+	}
+}
+
+func TestGetPrefersLowLoad(t *testing.T) {
+	busy := testEndpoint("busy:1", state_active, 5, 10)
+	idle := testEndpoint("idle:1", state_active, 1, 10)
+	col := EndpointCollection{busy, idle}
+	if got := col.Get(); got != idle {
+		t.Errorf("Get() returned %v, expected %v", got, idle)
+	}
+}
+
+func TestGetRoundRobinWithoutLoad(t *testing.T) {
+	first := testEndpoint("first:1", state_active, 0, 3)
+	second := testEndpoint("second:1", state_active, 0, 2)
+	col := EndpointCollection{first, second}
+	if got := col.Get(); got != second {
+		t.Errorf("Get() returned %v, expected endpoint with fewer requests %v", got, second)
+	}
+}
+
+func TestGetSkipsInactive(t *testing.T) {
+	inactive := testEndpoint("inactive:1", state_inactive, 0, 0)
+	overloaded := testEndpoint("overloaded:1", state_overloaded, 0, 0)
+	active := testEndpoint("active:1", state_active, 10, 100)
+	col := EndpointCollection{inactive, overloaded, active}
+	if got := col.Get(); got != active {
+		t.Errorf("Get() returned %v, expected %v", got, active)
+	}
+	if got := col[:2].Get(); got != nil {
+		t.Errorf("Get() returned %v without active endpoints", got)
+	}
+}
+
+func TestEmergencyGetIncludesOverloaded(t *testing.T) {
+	inactive := testEndpoint("inactive:1", state_inactive, 0, 0)
+	overloaded := testEndpoint("overloaded:1", state_overloaded, 0, 0)
+	col := EndpointCollection{inactive, overloaded}
+	if got := col.EmergencyGet(); got != overloaded {
+		t.Errorf("EmergencyGet() returned %v, expected %v", got, overloaded)
+	}
+	if got := col[:1].EmergencyGet(); got != nil {
+		t.Errorf("EmergencyGet() returned %v for inactive endpoint", got)
+	}
+	if got := (EndpointCollection{}).EmergencyGet(); got != nil {
+		t.Errorf("EmergencyGet() returned %v for empty collection", got)
+	}
+}
+
+func TestLocalRegistry(t *testing.T) {
+	reg := make(LocalRegistry)
+	a := testEndpoint("a:1", state_active, 0, 0)
+	b := testEndpoint("b:1", state_active, 0, 0)
+	reg.Add("svc", a)
+	reg.Add("svc", b)
+	reg.Add("other", testEndpoint("c:1", state_active, 0, 0))
+
+	endpoints, err := reg.Endpoints("svc")
+	if err != nil || len(endpoints) != 2 || endpoints[0] != a || endpoints[1] != b {
+		t.Errorf("Endpoints() returned %v, %v", endpoints, err)
+	}
+	if _, err := reg.Endpoints("missing"); err == nil {
+		t.Error("Endpoints() of unknown service did not fail")
+	}
+	if got := reg.Find("svc", "b:1"); got != b {
+		t.Errorf("Find() returned %v, expected %v", got, b)
+	}
+	if got := reg.Find("svc", "c:1"); got != nil {
+		t.Errorf("Find() returned endpoint %v of other service", got)
+	}
+	services := reg.Services()
+	sort.Strings(services)
+	if len(services) != 2 || services[0] != "other" || services[1] != "svc" {
+		t.Errorf("Services() returned %v", services)
+	}
+}
+
+func TestSlowStartWeight(t *testing.T) {
+	clock := newFakeClock()
+	linear := testEndpoint("linear:1", state_active, 0, 0)
+	exponential := testEndpoint("exponential:1", state_active, 0, 0)
+	for _, endpoint := range []*Endpoint{linear, exponential} {
+		WithEndpointClock(clock)(endpoint)
+		endpoint.activeSince = clock.Now().UnixNano()
+	}
+	WithSlowStart(10*time.Second, SlowStartLinear)(linear)
+	WithSlowStart(10*time.Second, SlowStartExponential)(exponential)
+
+	if w := linear.SlowStartWeight(); w != slow_start_min_weight {
+		t.Errorf("Initial linear weight %v", w)
+	}
+	clock.Advance(5 * time.Second)
+	if w := linear.SlowStartWeight(); math.Abs(w-0.525) > 0.001 {
+		t.Errorf("Linear weight after half the window: %v", w)
+	}
+	if w := exponential.SlowStartWeight(); math.Abs(w-math.Sqrt(slow_start_min_weight)) > 0.001 {
+		t.Errorf("Exponential weight after half the window: %v", w)
+	}
+	clock.Advance(5 * time.Second)
+	if w1, w2 := linear.SlowStartWeight(), exponential.SlowStartWeight(); w1 != 1 || w2 != 1 {
+		t.Errorf("Weights after the window: %v, %v", w1, w2)
+	}
+}
+
+// Let the endpoint become active like after recovering
+func activateTestEndpoint(endpoint *Endpoint) {
+	endpoint.activeLock.Lock()
+	defer endpoint.unlockActive()
+	endpoint.setActive()
+}
+
+// Dispatch the requests through Get() and return the share of the given endpoint
+func share(col EndpointCollection, endpoint *Endpoint, requests int) float64 {
+	picked := 0
+	for i := 0; i < requests; i++ {
+		got := col.Get()
+		got.startRequest()
+		got.releaseLoad()
+		if got == endpoint {
+			picked++
+		}
+	}
+	return float64(picked) / float64(requests)
+}
+
+func TestGetRampsUpSlowStart(t *testing.T) {
+	clock := newFakeClock()
+	ramping := testEndpoint("ramping:1", state_inactive, 0, 0)
+	WithEndpointClock(clock)(ramping)
+	WithSlowStart(10*time.Second, SlowStartLinear)(ramping)
+	established := testEndpoint("established:1", state_active, 0, 100000)
+	registry := make(LocalRegistry)
+	registry.Add("svc", ramping)
+	registry.Add("svc", established)
+	col := registry["svc"]
+	activateTestEndpoint(ramping)
+
+	// Expected share during the window: SlowStartWeight() / 2, from 2.5% to 50%
+	for second := 0; second < 20; second++ {
+		got := share(col, ramping, 1000)
+		expected := 0.5
+		if second < 10 {
+			expected = (slow_start_min_weight + (1-slow_start_min_weight)*float64(second)/10) / 2
+		}
+		if math.Abs(got-expected) > 0.06 {
+			t.Errorf("Share of endpoint in slow start after %vs: %.3f, expected %.3f", second, got, expected)
+		}
+		clock.Advance(time.Second)
+	}
+	if got := col[:1].Get(); got != ramping {
+		t.Errorf("Get() returned %v, expected only endpoint %v", got, ramping)
+	}
+}
+
+func TestGetRebasesRecoveredEndpoint(t *testing.T) {
+	recovered := testEndpoint("recovered:1", state_inactive, 0, 0)
+	established := testEndpoint("established:1", state_active, 0, 100000)
+	registry := make(LocalRegistry)
+	registry.Add("svc", recovered)
+	registry.Add("svc", established)
+	col := registry["svc"]
+	activateTestEndpoint(recovered)
+	if got := share(col, recovered, 100); math.Abs(got-0.5) > 0.02 {
+		t.Errorf("Share of recovered endpoint without slow start: %.3f, expected 0.5", got)
+	}
+	if reqs := recovered.Reqs(); reqs != 50 {
+		t.Errorf("Requests of recovered endpoint: %v", reqs)
+	}
+}
+
+func TestNoSlowStartAfterFirstCheck(t *testing.T) {
+	clock := newFakeClock()
+	endpoint := testEndpoint("new:1", state_unknown, 0, 0)
+	WithEndpointClock(clock)(endpoint)
+	WithSlowStart(10*time.Second, SlowStartLinear)(endpoint)
+	clock.Advance(time.Second)
+	activateTestEndpoint(endpoint)
+	if weight := endpoint.SlowStartWeight(); weight != 1 {
+		t.Errorf("Slow start after the first check of the endpoint: %v", weight)
+	}
+	if _, rebasing := endpoint.balancedReqs(); rebasing {
+		t.Errorf("Endpoint rebased after the first check")
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	path_wildcard = "*"
+	form_mimetype = "application/x-www-form-urlencoded"
+
+	// Larger request bodies are not buffered, only the query is matched against form conditions
+	max_form_body_size = 1 << 20
+)
+
+// Sends requests matching all configured conditions to a subset of endpoints.
+// Empty conditions match every request.
+type Route struct {
+	Name string
+
+	// Matched as prefix of the request path, segment by segment.
+	// A segment consisting of "*" matches any single path segment.
+	Path string
+
+	Methods     []string
+	Header      string
+	HeaderValue string // Only the presence of the header is checked, if this is empty
+	FormKey     string // Query parameters or url-encoded request body
+	FormValue   string // Only the presence of the form key is checked, if this is empty
+
+	Endpoints EndpointCollection
+
+	// Overrides the criticality declared in the CriticalityHeader, see LoadShedder
+	Criticality Criticality
+
+	lock     sync.Mutex
+	requests uint
+}
+
+type RouteStats struct {
+	Rule      string
+	Requests  uint
+	Endpoints map[string]Stats
+}
+
+func (route *Route) String() string {
+	var parts []string
+	if len(route.Methods) > 0 {
+		parts = append(parts, strings.Join(route.Methods, ","))
+	}
+	if route.Path != "" {
+		parts = append(parts, route.Path)
+	}
+	if route.Header != "" {
+		parts = append(parts, "header "+route.Header+conditionValue(route.HeaderValue))
+	}
+	if route.FormKey != "" {
+		parts = append(parts, "form "+route.FormKey+conditionValue(route.FormValue))
+	}
+	if len(parts) == 0 {
+		return "(all requests)"
+	}
+	return strings.Join(parts, " ")
+}
+
+func conditionValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "=" + value
+}
+
+func (route *Route) Matches(req *http.Request) bool {
+	if !route.matchesMethod(req.Method) || !matchPath(route.Path, req.URL.Path) {
+		return false
+	}
+	if route.Header != "" {
+		values, ok := req.Header[http.CanonicalHeaderKey(route.Header)]
+		if !ok || !matchValue(route.HeaderValue, values) {
+			return false
+		}
+	}
+	if route.FormKey != "" {
+		form, err := formValues(req)
+		if err != nil {
+			logger.Tracef("Failed to parse form of %s for route %s: %v", req.URL.Path, route.Name, err)
+			return false
+		}
+		values, ok := form[route.FormKey]
+		if !ok || !matchValue(route.FormValue, values) {
+			return false
+		}
+	}
+	return true
+}
+
+func (route *Route) matchesMethod(method string) bool {
+	if len(route.Methods) == 0 {
+		return true
+	}
+	for _, m := range route.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPath(pattern, path string) bool {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	if len(patternSegments) == 1 && patternSegments[0] == "" {
+		return true
+	}
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(pathSegments) < len(patternSegments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if segment != path_wildcard && segment != pathSegments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func matchValue(expected string, values []string) bool {
+	if expected == "" {
+		return true
+	}
+	for _, value := range values {
+		if value == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse the query and, for url-encoded requests up to max_form_body_size, the body without consuming it
+func formValues(req *http.Request) (url.Values, error) {
+	form := req.URL.Query()
+	if req.Body == nil {
+		return form, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != form_mimetype {
+		return form, nil
+	}
+	body, buffered, err := bufferLimitedBody(req, max_form_body_size)
+	if err != nil {
+		return nil, err
+	}
+	if !buffered {
+		logger.Tracef("Not parsing form of %s: body too large", req.URL.Path)
+		return form, nil
+	}
+	bodyForm, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range bodyForm {
+		form[key] = append(form[key], values...)
+	}
+	return form, nil
+}
+
+func (route *Route) countRequest() {
+	route.lock.Lock()
+	defer route.lock.Unlock()
+	route.requests++
+}
+
+func (route *Route) Stats() *RouteStats {
+	route.lock.Lock()
+	stats := &RouteStats{
+		Rule:      route.String(),
+		Requests:  route.requests,
+		Endpoints: make(map[string]Stats),
+	}
+	route.lock.Unlock()
+	for _, endpoint := range route.Endpoints {
+		eStats := Stats{}
+		eStats.fillFrom(endpoint.Snapshot())
+		eStats.compute()
+		stats.Endpoints[endpoint.Name()] = eStats
+	}
+	return stats
+}
+
+// Return the first matching route, or nil
+func (config *ServiceConfig) route(req *http.Request) *Route {
+	for _, route := range config.Routes {
+		if route.Matches(req) {
+			route.countRequest()
+			return route
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouteFormMatching(t *testing.T) {
+	route := &Route{Name: "reads", FormKey: "op", FormValue: "read"}
+	large := "op=read&data=" + strings.Repeat("x", max_form_body_size)
+	for _, test := range []struct {
+		query, body string
+		matches     bool
+	}{
+		{"?op=read", "", true},
+		{"", "op=read", true},
+		{"", "op=write", false},
+		{"", large, false},
+		{"?op=read", large, true},
+	} {
+		req, err := http.NewRequest("POST", "http://svc/path"+test.query, ioutil.NopCloser(strings.NewReader(test.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", form_mimetype)
+		if matches := route.Matches(req); matches != test.matches {
+			t.Errorf("Query %q and body of %v bytes matched: %v", test.query, len(test.body), matches)
+		}
+		// The body is still available for forwarding
+		if body, err := ioutil.ReadAll(req.Body); err != nil || string(body) != test.body {
+			t.Errorf("Body of %v bytes not preserved, got %v bytes: %v", len(test.body), len(body), err)
+		}
+	}
+}
+
+func TestStatsIncludeRouteEndpoints(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+	routeBackend := httptest.NewServer(okHandler)
+	defer routeBackend.Close()
+	routeEndpoint := NewEndpoint("svc", hostOf(routeBackend))
+	director := newTestDirector(newFakeClock(), NewEndpoint("svc", hostOf(backend)))
+	director.config.Routes = []*Route{{Name: "all", Endpoints: EndpointCollection{routeEndpoint}}}
+
+	if status, _ := roundTrip(t, director); status != http.StatusOK {
+		t.Fatalf("Unexpected response %v", status)
+	}
+	stats := director.proxy.Stats()["svc"]
+	if routeStats, ok := stats.Endpoints[routeEndpoint.Name()]; !ok || routeStats.Requests != 1 || stats.Requests != 1 {
+		t.Errorf("Route endpoint missing in the service stats: %+v", stats)
+	}
+	if counters, ok := director.proxy.snapshot().services["svc"][routeEndpoint.Name()]; !ok || counters.reqs != 1 {
+		t.Errorf("Route endpoint missing in the history: %+v", counters)
+	}
+}
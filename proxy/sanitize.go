@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/antongulenko/http-isolation-proxy/services"
+)
+
+const (
+	ServiceHeader = "X-Isolator-Service"
+)
+
+// Enforces size limits and rewrites the headers of requests and responses of one service.
+// Hop-by-hop headers are always removed by httputil.ReverseProxy, which also appends the
+// client address to X-Forwarded-For. RemoveRequestHeaders are removed before that, so
+// adding X-Forwarded-For discards only the values supplied by clients.
+type Sanitizer struct {
+	MaxBodySize   int64 // No limit, if <= 0
+	MaxHeaderSize int   // No limit, if <= 0
+
+	RemoveRequestHeaders  []string
+	AddRequestHeaders     http.Header
+	RemoveResponseHeaders []string
+	AddResponseHeaders    http.Header
+
+	// Add the ServiceHeader containing the service name to forwarded requests
+	AddServiceHeader bool
+
+	lock            sync.Mutex
+	bodyTooLarge    uint
+	headersTooLarge uint
+}
+
+type SanitizerStats struct {
+	MaxBodySize     int64
+	MaxHeaderSize   int
+	BodyTooLarge    uint
+	HeadersTooLarge uint
+}
+
+func headerSize(header http.Header) int {
+	size := 0
+	for key, values := range header {
+		for _, value := range values {
+			size += len(key) + len(value) + 4 // ": " and "\r\n"
+		}
+	}
+	return size
+}
+
+// Return an error response, if the request exceeds one of the limits
+func (sanitizer *Sanitizer) checkRequest(req *http.Request) *http.Response {
+	if sanitizer.MaxHeaderSize > 0 {
+		if size := headerSize(req.Header) + len(req.URL.RequestURI()); size > sanitizer.MaxHeaderSize {
+			sanitizer.count(&sanitizer.headersTooLarge)
+			return services.MakeHttpResponse(req, http.StatusRequestHeaderFieldsTooLarge,
+				"Request headers exceed "+strconv.Itoa(sanitizer.MaxHeaderSize)+" bytes\n")
+		}
+	}
+	if sanitizer.MaxBodySize > 0 && req.Body != nil {
+		if req.ContentLength > sanitizer.MaxBodySize {
+			return sanitizer.rejectBody(req)
+		}
+		if req.ContentLength < 0 {
+			// Unknown length: buffer at most one byte more than allowed
+			body, err := ioutil.ReadAll(io.LimitReader(req.Body, sanitizer.MaxBodySize+1))
+			_ = req.Body.Close()
+			if err != nil {
+				return services.MakeHttpResponse(req, http.StatusBadRequest, "Failed to read request body\n")
+			}
+			if int64(len(body)) > sanitizer.MaxBodySize {
+				return sanitizer.rejectBody(req)
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+	}
+	return nil
+}
+
+func (sanitizer *Sanitizer) rejectBody(req *http.Request) *http.Response {
+	sanitizer.count(&sanitizer.bodyTooLarge)
+	return services.MakeHttpResponse(req, http.StatusRequestEntityTooLarge,
+		"Request body exceeds "+strconv.FormatInt(sanitizer.MaxBodySize, 10)+" bytes\n")
+}
+
+// Called by Director.direct(), before httputil.ReverseProxy adds its own headers
+func (sanitizer *Sanitizer) stripRequest(req *http.Request) {
+	rewriteHeader(req.Header, sanitizer.RemoveRequestHeaders, nil)
+}
+
+func (sanitizer *Sanitizer) rewriteRequest(req *http.Request, serviceName string) {
+	rewriteHeader(req.Header, nil, sanitizer.AddRequestHeaders)
+	if sanitizer.AddServiceHeader {
+		req.Header.Set(ServiceHeader, serviceName)
+	}
+}
+
+func (sanitizer *Sanitizer) rewriteResponse(resp *http.Response) {
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	rewriteHeader(resp.Header, sanitizer.RemoveResponseHeaders, sanitizer.AddResponseHeaders)
+}
+
+func rewriteHeader(header http.Header, remove []string, add http.Header) {
+	for _, key := range remove {
+		header.Del(key)
+	}
+	for key, values := range add {
+		header.Del(key)
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+}
+
+func (sanitizer *Sanitizer) count(counter *uint) {
+	sanitizer.lock.Lock()
+	defer sanitizer.lock.Unlock()
+	*counter++
+}
+
+func (sanitizer *Sanitizer) Stats() *SanitizerStats {
+	sanitizer.lock.Lock()
+	defer sanitizer.lock.Unlock()
+	return &SanitizerStats{
+		MaxBodySize:     sanitizer.MaxBodySize,
+		MaxHeaderSize:   sanitizer.MaxHeaderSize,
+		BodyTooLarge:    sanitizer.bodyTooLarge,
+		HeadersTooLarge: sanitizer.headersTooLarge,
+	}
+}
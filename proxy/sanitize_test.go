@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSanitizerKeepsProxyForwardedFor(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Forwarded-For") + "|" + r.Header.Get("X-Secret") + "|" + r.Header.Get("X-Added")))
+	}))
+	defer backend.Close()
+	registry := make(LocalRegistry)
+	registry.Add("svc", NewEndpoint("svc", hostOf(backend)))
+	p := NewIsolationProxyWithOptions(WithRegistry(registry))
+	p.Configure("svc").Sanitizer = &Sanitizer{
+		RemoveRequestHeaders: []string{"X-Forwarded-For", "X-Secret"},
+		AddRequestHeaders:    http.Header{"X-Added": {"yes"}},
+	}
+	front := httptest.NewServer(p.Handler("svc"))
+	defer front.Close()
+
+	req, err := http.NewRequest("GET", front.URL+"/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "6.6.6.6")
+	req.Header.Set("X-Secret", "spoofed")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client address appended by the proxy is kept, the spoofed one is removed
+	if expected := "127.0.0.1||yes"; string(body) != expected {
+		t.Errorf("Upstream received headers %q, expected %q", body, expected)
+	}
+}
@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	default_shadow_timeout        = 10 * time.Second
+	default_shadow_max_concurrent = 20
+	default_shadow_max_body_size  = 1 << 20
+)
+
+// Mirrors a percentage of the requests of a service to a set of shadow endpoints.
+// The responses of the shadow endpoints are discarded, only the differences
+// in status code and latency compared to the primary endpoints are recorded.
+// Shadow requests use their own connections, so slow shadow endpoints do not
+// affect the primary endpoints.
+type Shadow struct {
+	// Used in turn. Only their hosts are used, mirrored requests do not change
+	// their state, their results are only recorded in the ShadowStats.
+	Endpoints EndpointCollection
+	Percent   float64
+
+	// Shadow requests are aborted after this time, default_shadow_timeout if zero
+	Timeout time.Duration
+
+	// Sampled requests are not mirrored while this many shadow requests are running,
+	// default_shadow_max_concurrent if zero
+	MaxConcurrent int
+
+	// Requests with larger bodies are not mirrored, because their body would have
+	// to be held in memory. default_shadow_max_body_size if zero.
+	MaxBodySize int64
+
+	transportOnce sync.Once
+	transport     *http.Transport
+
+	lock             sync.Mutex
+	next             int // Index of the next endpoint
+	endpointStats    map[*Endpoint]*Stats
+	running          int
+	requests         uint
+	errors           uint
+	dropped          uint
+	statusMismatches uint
+	latencyDiff      time.Duration
+}
+
+type ShadowStats struct {
+	Requests         uint
+	Errors           uint // Including timeouts
+	Dropped          uint // Not mirrored due to MaxConcurrent or MaxBodySize
+	Running          int
+	StatusMismatches uint
+	AvgLatencyDiff   string
+	Endpoints        map[string]Stats // Active if the last shadow request succeeded
+}
+
+func (shadow *Shadow) sample() bool {
+	return shadow.Percent > 0 && rand.Float64()*100 < shadow.Percent
+}
+
+func (shadow *Shadow) timeout() time.Duration {
+	if shadow.Timeout > 0 {
+		return shadow.Timeout
+	}
+	return default_shadow_timeout
+}
+
+func (shadow *Shadow) maxBodySize() int64 {
+	if shadow.MaxBodySize > 0 {
+		return shadow.MaxBodySize
+	}
+	return default_shadow_max_body_size
+}
+
+func (shadow *Shadow) maxConcurrent() int {
+	if shadow.MaxConcurrent > 0 {
+		return shadow.MaxConcurrent
+	}
+	return default_shadow_max_concurrent
+}
+
+// Based on http.DefaultTransport, separate from the transport of the proxy
+func (shadow *Shadow) getTransport() *http.Transport {
+	shadow.transportOnce.Do(func() {
+		timeout := shadow.timeout()
+		shadow.transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: timeout,
+			}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConnsPerHost:   shadow.maxConcurrent(),
+		}
+	})
+	return shadow.transport
+}
+
+// Reserve one of the MaxConcurrent shadow requests. Return false and count the
+// request as dropped, if all are running. Must be followed by release().
+func (shadow *Shadow) acquire() bool {
+	shadow.lock.Lock()
+	defer shadow.lock.Unlock()
+	if shadow.running >= shadow.maxConcurrent() {
+		shadow.dropped++
+		return false
+	}
+	shadow.running++
+	return true
+}
+
+func (shadow *Shadow) release() {
+	shadow.lock.Lock()
+	defer shadow.lock.Unlock()
+	shadow.running--
+}
+
+// Release the reserved shadow request and count the request as dropped
+func (shadow *Shadow) drop() {
+	shadow.lock.Lock()
+	defer shadow.lock.Unlock()
+	shadow.running--
+	shadow.dropped++
+}
+
+func (shadow *Shadow) nextEndpoint() *Endpoint {
+	shadow.lock.Lock()
+	defer shadow.lock.Unlock()
+	if len(shadow.Endpoints) == 0 {
+		return nil
+	}
+	endpoint := shadow.Endpoints[shadow.next%len(shadow.Endpoints)]
+	shadow.next++
+	return endpoint
+}
+
+// Must be called after the primary response has been received, and after acquire().
+// req must be a copy of the original request, see copyRequest().
+func (shadow *Shadow) mirror(req *http.Request, primaryStatus int, primaryDuration time.Duration) {
+	defer shadow.release()
+	endpoint := shadow.nextEndpoint()
+	if endpoint == nil {
+		logger.Tracef("Not mirroring %s: no shadow endpoint", req.URL.Path)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), shadow.timeout())
+	defer cancel()
+	req = req.WithContext(ctx)
+	endpoint.ConfigureUrl(req.URL)
+	start := time.Now()
+	resp, err := shadow.getTransport().RoundTrip(req)
+	if err == nil {
+		// Response is discarded, but must be consumed to reuse the connection
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	duration := time.Now().Sub(start)
+
+	shadow.lock.Lock()
+	defer shadow.lock.Unlock()
+	shadow.requests++
+	if shadow.endpointStats == nil {
+		shadow.endpointStats = make(map[*Endpoint]*Stats)
+	}
+	eStats := shadow.endpointStats[endpoint]
+	if eStats == nil {
+		eStats = new(Stats)
+		shadow.endpointStats[endpoint] = eStats
+	}
+	eStats.Requests++
+	eStats.totalDuration += duration
+	eStats.Active = err == nil
+	if err != nil {
+		logger.Tracef("Error mirroring %s to %v: %v", req.URL.Path, endpoint, err)
+		eStats.Errors++
+		shadow.errors++
+		return
+	}
+	if resp.StatusCode != primaryStatus {
+		logger.Logf("Shadow %v responded %v to %s, primary responded %v", endpoint, resp.StatusCode, req.URL.Path, primaryStatus)
+		shadow.statusMismatches++
+	}
+	shadow.latencyDiff += duration - primaryDuration
+}
+
+func (shadow *Shadow) Stats() *ShadowStats {
+	shadow.lock.Lock()
+	defer shadow.lock.Unlock()
+	stats := &ShadowStats{
+		Requests:         shadow.requests,
+		Errors:           shadow.errors,
+		Dropped:          shadow.dropped,
+		Running:          shadow.running,
+		StatusMismatches: shadow.statusMismatches,
+		Endpoints:        make(map[string]Stats),
+	}
+	if compared := shadow.requests - shadow.errors; compared == 0 {
+		stats.AvgLatencyDiff = "(no data)"
+	} else {
+		stats.AvgLatencyDiff = (shadow.latencyDiff / time.Duration(compared)).String()
+	}
+	for _, endpoint := range shadow.Endpoints {
+		eStats := Stats{}
+		if recorded := shadow.endpointStats[endpoint]; recorded != nil {
+			eStats = *recorded
+		}
+		eStats.compute()
+		stats.Endpoints[endpoint.Name()] = eStats
+	}
+	return stats
+}
+
+// Read the request body so that it can be sent multiple times, if it is not larger than
+// limit. Otherwise, the request keeps its entire body and false is returned.
+func bufferLimitedBody(req *http.Request, limit int64) ([]byte, bool, error) {
+	if req.Body == nil {
+		return nil, true, nil
+	}
+	if req.ContentLength > limit {
+		return nil, false, nil
+	}
+	// Unknown length: buffer at most one byte more than allowed
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		_ = req.Body.Close()
+		return nil, false, err
+	}
+	if int64(len(body)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	_ = req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+// The copy is detached from the context of the original request, because
+// it is sent after the original request has been answered.
+func copyRequest(req *http.Request, body []byte) *http.Request {
+	result := new(http.Request)
+	*result = *req
+	u := *req.URL
+	result.URL = &u
+	result.Header = make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		result.Header[key] = append([]string(nil), values...)
+	}
+	if body != nil {
+		result.Body = ioutil.NopCloser(bytes.NewReader(body))
+		result.ContentLength = int64(len(body))
+	}
+	return result.WithContext(context.Background())
+}
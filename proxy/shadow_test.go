@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShadowLimitsHungMirrors(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+	hung := make(chan struct{})
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(func() { close(hung) }) }
+	shadowBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer shadowBackend.Close()
+	defer release()
+
+	director := newTestDirector(newFakeClock(), NewEndpoint("svc", hostOf(backend)))
+	shadow := &Shadow{
+		Endpoints:     EndpointCollection{NewEndpoint("svc shadow", hostOf(shadowBackend))},
+		Percent:       100,
+		Timeout:       time.Minute, // The hung requests are released below
+		MaxConcurrent: 2,
+	}
+	director.config.Shadow = shadow
+	for i := 0; i < 5; i++ {
+		if status, body := roundTrip(t, director); status != http.StatusOK || body != "ok" {
+			t.Fatalf("Primary response %v: %v", status, body)
+		}
+	}
+	if stats := shadow.Stats(); stats.Dropped != 3 || stats.Running != 2 {
+		t.Errorf("Unexpected stats while shadow endpoint hangs: %+v", stats)
+	}
+
+	release()
+	eventually(t, "the hung shadow requests finished", func() bool { return shadow.Stats().Running == 0 })
+	if stats := shadow.Stats(); stats.Requests != 2 || stats.Errors != 0 {
+		t.Errorf("Unexpected stats after releasing the shadow endpoint: %+v", stats)
+	}
+}
+
+func TestShadowTimesOut(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+	hung := make(chan struct{})
+	shadowBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer shadowBackend.Close()
+	defer close(hung)
+
+	director := newTestDirector(newFakeClock(), NewEndpoint("svc", hostOf(backend)))
+	shadow := &Shadow{
+		Endpoints: EndpointCollection{NewEndpoint("svc shadow", hostOf(shadowBackend))},
+		Percent:   100,
+		Timeout:   50 * time.Millisecond,
+	}
+	director.config.Shadow = shadow
+	if status, body := roundTrip(t, director); status != http.StatusOK || body != "ok" {
+		t.Fatalf("Primary response %v: %v", status, body)
+	}
+	eventually(t, "the hung shadow request timed out", func() bool { return shadow.Stats().Running == 0 })
+	if stats := shadow.Stats(); stats.Requests != 1 || stats.Errors != 1 {
+		t.Errorf("Hung shadow request did not time out: %+v", stats)
+	}
+}
+
+func TestShadowKeepsEndpointState(t *testing.T) {
+	backend := httptest.NewServer(okHandler)
+	defer backend.Close()
+	shadowBackend := httptest.NewServer(failingHandler)
+	defer shadowBackend.Close()
+
+	director := newTestDirector(newFakeClock(), NewEndpoint("svc", hostOf(backend)))
+	shadowEndpoint := NewEndpoint("svc shadow", hostOf(shadowBackend), WithEndpointClock(newFakeClock()))
+	shadow := &Shadow{Endpoints: EndpointCollection{shadowEndpoint}, Percent: 100}
+	director.config.Shadow = shadow
+	director.proxy.observe("svc")
+	if status, _ := roundTrip(t, director); status != http.StatusOK {
+		t.Fatalf("Primary response %v", status)
+	}
+	eventually(t, "the shadow request finished", func() bool { return shadow.Stats().Requests == 1 })
+
+	stats := shadow.Stats()
+	if eStats := stats.Endpoints[shadowEndpoint.Name()]; stats.Errors != 1 || eStats.Requests != 1 || eStats.Errors != 1 || eStats.Active {
+		t.Errorf("Unexpected shadow stats: %+v", stats)
+	}
+	if snapshot := shadowEndpoint.Snapshot(); !snapshot.Active || snapshot.Requests != 0 || snapshot.Errors != 0 {
+		t.Errorf("Shadow request changed %v: %+v", shadowEndpoint, snapshot)
+	}
+	if events := director.proxy.events.subscribe(); len(events) != 0 {
+		t.Errorf("Shadow request published %v", <-events)
+	}
+}
+
+func TestShadowSkipsLargeBodies(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	})
+	backend := httptest.NewServer(echo)
+	defer backend.Close()
+	mirrored := make(chan string, 10)
+	shadowBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- string(body)
+	}))
+	defer shadowBackend.Close()
+
+	director := newTestDirector(newFakeClock(), NewEndpoint("svc", hostOf(backend)))
+	shadow := &Shadow{
+		Endpoints:   EndpointCollection{NewEndpoint("svc shadow", hostOf(shadowBackend))},
+		Percent:     100,
+		MaxBodySize: 10,
+	}
+	director.config.Shadow = shadow
+	for _, body := range []string{"small", strings.Repeat("large", 10)} {
+		// Unknown length, the body has to be read to find out whether it is too large
+		req, err := http.NewRequest("POST", "http://svc/path", ioutil.NopCloser(strings.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		director.direct(req)
+		resp, err := director.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forwarded, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(forwarded) != body {
+			t.Errorf("Primary received %q, expected %q", forwarded, body)
+		}
+	}
+	if body := <-mirrored; body != "small" {
+		t.Errorf("Mirrored body %q", body)
+	}
+	eventually(t, "the shadow request finished", func() bool { return shadow.Stats().Running == 0 })
+	if stats := shadow.Stats(); stats.Requests != 1 || stats.Dropped != 1 || len(mirrored) != 0 {
+		t.Errorf("Unexpected stats after large body: %+v", stats)
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+type SlowStartMode string
+
+const (
+	// The weight grows by the same amount in every part of the window
+	SlowStartLinear = SlowStartMode("linear")
+
+	// The weight doubles in equal steps, staying low for most of the window
+	SlowStartExponential = SlowStartMode("exponential")
+)
+
+// Weight of an endpoint at the beginning of its slow start window
+const slow_start_min_weight = 0.05
+
+func ParseSlowStartMode(mode string) (SlowStartMode, error) {
+	switch result := SlowStartMode(mode); result {
+	case "":
+		return SlowStartLinear, nil
+	case SlowStartLinear, SlowStartExponential:
+		return result, nil
+	default:
+		return "", fmt.Errorf("Unknown slow start mode: %v", mode)
+	}
+}
+
+// Ramp up the share of requests of the endpoint during the window after it
+// becomes active, to avoid overloading it again right after it recovered.
+func WithSlowStart(window time.Duration, mode SlowStartMode) EndpointOption {
+	return func(endpoint *Endpoint) {
+		endpoint.SlowStart = window
+		endpoint.SlowStartMode = mode
+	}
+}
+
+// The fraction of its full share of requests that the endpoint should receive, between
+// slow_start_min_weight and 1. Below 1 during the SlowStart window after becoming active.
+func (endpoint *Endpoint) SlowStartWeight() float64 {
+	if endpoint.SlowStart <= 0 {
+		return 1
+	}
+	since := time.Unix(0, atomic.LoadInt64(&endpoint.activeSince))
+	elapsed := endpoint.clock().Now().Sub(since)
+	if elapsed < 0 || elapsed >= endpoint.SlowStart {
+		return 1
+	}
+	progress := float64(elapsed) / float64(endpoint.SlowStart)
+	if endpoint.SlowStartMode == SlowStartExponential {
+		return slow_start_min_weight * math.Pow(1/slow_start_min_weight, progress)
+	}
+	return slow_start_min_weight + (1-slow_start_min_weight)*progress
+}
+
+// Randomly decide to skip an endpoint with the given SlowStartWeight() in Get(), so that
+// it is only considered for its weighted share of the given number of candidates.
+func skipSlowStart(weight float64, candidates int) bool {
+	return weight < 1 && rand.Float64() >= weight/float64(candidates)
+}
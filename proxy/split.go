@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/antongulenko/http-isolation-proxy/services"
+)
+
+const (
+	default_canary_min_requests = 50
+	default_canary_window       = time.Minute
+	default_version             = "default"
+)
+
+// Splits the traffic of a service between endpoint versions according to the
+// weights of the endpoints, see Endpoint.Version and Endpoint.Weight.
+type VersionSplit struct {
+	// Pin clients to a version using a cookie with this name, if not empty
+	Cookie string
+
+	// Pin clients to a version based on this form value (e.g. "user"), if not empty.
+	// The cookie takes precedence.
+	FormKey string
+
+	// If the error rate of the Canary version exceeds the error rate of the
+	// Baseline version (default version if empty) by more than MaxErrorRateDiff,
+	// the canary does not receive any more traffic until Reset() is called.
+	// The error rates are compared every history_interval over the last Window
+	// (default_canary_window if 0) while the proxy records its history, see RecordHistory().
+	// MinRequests is the number of requests the canary must have handled in the
+	// Window before this decision is taken.
+	Canary           string
+	Baseline         string
+	MaxErrorRateDiff float64
+	MinRequests      uint
+	Window           time.Duration
+
+	lock       sync.Mutex
+	rolledBack bool
+}
+
+type VersionStats struct {
+	Weight     uint
+	Requests   uint
+	Errors     int
+	ErrorRate  float64
+	RolledBack bool `json:",omitempty"`
+}
+
+type versionSet struct {
+	names     []string // Preserves a deterministic order
+	endpoints map[string]EndpointCollection
+	weights   map[string]uint
+}
+
+func (endpoint *Endpoint) version() string {
+	if endpoint.Version == "" {
+		return default_version
+	}
+	return endpoint.Version
+}
+
+func (endpoint *Endpoint) effectiveWeight() uint {
+	if endpoint.Weight == 0 {
+		return 1
+	}
+	return endpoint.Weight
+}
+
+func groupVersions(endpoints EndpointCollection, onlyActive bool) *versionSet {
+	set := &versionSet{
+		endpoints: make(map[string]EndpointCollection),
+		weights:   make(map[string]uint),
+	}
+	for _, endpoint := range endpoints {
+		if onlyActive && !endpoint.Active() {
+			continue
+		}
+		version := endpoint.version()
+		if _, ok := set.endpoints[version]; !ok {
+			set.names = append(set.names, version)
+		}
+		set.endpoints[version] = append(set.endpoints[version], endpoint)
+		set.weights[version] += endpoint.effectiveWeight()
+	}
+	return set
+}
+
+func (set *versionSet) errorRate(version string) (float64, uint) {
+	var reqs uint
+	var errors int
+	for _, endpoint := range set.endpoints[version] {
+		reqs += endpoint.Reqs()
+		errors += endpoint.Errors()
+	}
+	if reqs == 0 {
+		return 0, 0
+	}
+	return float64(errors) / float64(reqs), reqs
+}
+
+// Error rate and number of requests of the version in the given rates, by endpoint name
+func (set *versionSet) windowErrorRate(version string, rates map[string]*RateStats) (float64, uint) {
+	var reqs uint
+	var errors int
+	for _, endpoint := range set.endpoints[version] {
+		if rate, ok := rates[endpoint.Name()]; ok {
+			reqs += rate.requests
+			errors += rate.errors
+		}
+	}
+	if reqs == 0 {
+		return 0, 0
+	}
+	return float64(errors) / float64(reqs), reqs
+}
+
+func (split *VersionSplit) RolledBack() bool {
+	split.lock.Lock()
+	defer split.lock.Unlock()
+	return split.rolledBack
+}
+
+// Let the canary version receive traffic again after it was rolled back.
+// Return false, if it was not rolled back.
+func (split *VersionSplit) Reset() bool {
+	split.lock.Lock()
+	defer split.lock.Unlock()
+	rolledBack := split.rolledBack
+	split.rolledBack = false
+	return rolledBack
+}
+
+func (split *VersionSplit) window() time.Duration {
+	if split.Window <= 0 {
+		return default_canary_window
+	}
+	return split.Window
+}
+
+// Roll back the canary version if necessary, based on the rates of the endpoints in the
+// last window. Return a description, if it was rolled back now.
+func (split *VersionSplit) checkCanary(all *versionSet, rates map[string]*RateStats) string {
+	if split.Canary == "" {
+		return ""
+	}
+	split.lock.Lock()
+	defer split.lock.Unlock()
+	if split.rolledBack {
+		return ""
+	}
+	minRequests := split.MinRequests
+	if minRequests == 0 {
+		minRequests = default_canary_min_requests
+	}
+	baseline := split.Baseline
+	if baseline == "" {
+		baseline = default_version
+	}
+	canaryRate, canaryReqs := all.windowErrorRate(split.Canary, rates)
+	baselineRate, _ := all.windowErrorRate(baseline, rates)
+	if canaryReqs >= minRequests && canaryRate > baselineRate+split.MaxErrorRateDiff {
+		message := fmt.Sprintf("Rolling back canary version %s: error rate %.3f, baseline %s error rate %.3f in the last %v",
+			split.Canary, canaryRate, baseline, baselineRate, split.window())
+		logger.Warnf("%s", message)
+		split.rolledBack = true
+		return message
+	}
+	return ""
+}
+
+// Return the endpoints of the version that should handle the request
+func (split *VersionSplit) choose(req *http.Request, endpoints EndpointCollection) EndpointCollection {
+	active := groupVersions(endpoints, true)
+	if split.RolledBack() && len(active.names) > 1 {
+		delete(active.weights, split.Canary)
+	}
+	if len(active.weights) == 0 {
+		return endpoints
+	}
+	if version, ok := split.pinnedVersion(req, active); ok {
+		return active.endpoints[version]
+	}
+
+	var total uint
+	for _, weight := range active.weights {
+		total += weight
+	}
+	var pick uint
+	if key := split.pinningKey(req); key != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		pick = uint(h.Sum32()) % total
+	} else {
+		pick = uint(rand.Int63n(int64(total)))
+	}
+	for _, version := range active.names {
+		weight, ok := active.weights[version]
+		if !ok {
+			continue
+		}
+		if pick < weight {
+			return active.endpoints[version]
+		}
+		pick -= weight
+	}
+	return endpoints
+}
+
+func (split *VersionSplit) pinnedVersion(req *http.Request, active *versionSet) (string, bool) {
+	if split.Cookie == "" {
+		return "", false
+	}
+	cookie, err := req.Cookie(split.Cookie)
+	if err != nil {
+		return "", false
+	}
+	_, ok := active.weights[cookie.Value]
+	return cookie.Value, ok
+}
+
+func (split *VersionSplit) pinningKey(req *http.Request) string {
+	if split.FormKey == "" {
+		return ""
+	}
+	form, err := formValues(req)
+	if err != nil {
+		return ""
+	}
+	return form.Get(split.FormKey)
+}
+
+// Let the client stick to the version that handled its request
+func (split *VersionSplit) pin(req *http.Request, resp *http.Response, endpoint *Endpoint) {
+	if split.Cookie == "" {
+		return
+	}
+	if cookie, err := req.Cookie(split.Cookie); err == nil && cookie.Value == endpoint.version() {
+		return
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	cookie := &http.Cookie{
+		Name:  split.Cookie,
+		Value: endpoint.version(),
+		Path:  "/",
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
+
+func (split *VersionSplit) Stats(endpoints EndpointCollection) map[string]*VersionStats {
+	all := groupVersions(endpoints, false)
+	rolledBack := split.RolledBack()
+	result := make(map[string]*VersionStats)
+	for _, version := range all.names {
+		rate, reqs := all.errorRate(version)
+		stats := &VersionStats{
+			Weight:    all.weights[version],
+			Requests:  reqs,
+			ErrorRate: rate,
+		}
+		for _, endpoint := range all.endpoints[version] {
+			stats.Errors += endpoint.Errors()
+		}
+		if rolledBack && version == split.Canary {
+			stats.RolledBack = true
+			stats.Weight = 0
+		}
+		result[version] = stats
+	}
+	return result
+}
+
+// Check the canary versions of all services against the rates in their window before now
+func (proxy *IsolationProxy) checkCanaries(now *snapshot) {
+	for _, service := range proxy.Registry.Services() {
+		config := proxy.existingConfig(service)
+		if config == nil || config.Split == nil || config.Split.Canary == "" {
+			continue
+		}
+		split := config.Split
+		endpoints, err := proxy.Registry.Endpoints(service)
+		if err != nil {
+			continue
+		}
+		from := proxy.history.since(now.time, split.window())
+		if from == nil || from == now {
+			continue
+		}
+		_, endpointRates := ratesBetween(from, now)
+		all := groupVersions(proxy.serviceEndpoints(service, endpoints), false)
+		if message := split.checkCanary(all, endpointRates[service]); message != "" {
+			proxy.PublishEvent(Event{Type: EventCircuit, Service: service, Message: message})
+		}
+	}
+}
+
+// Let a rolled back canary version receive traffic again, see VersionSplit.Reset()
+func (proxy *IsolationProxy) ResetCanary(serviceName string) error {
+	config := proxy.existingConfig(serviceName)
+	if config == nil || config.Split == nil || config.Split.Canary == "" {
+		return fmt.Errorf("Service %v has no canary version", serviceName)
+	}
+	if !config.Split.Reset() {
+		return fmt.Errorf("Canary version %v of service %v is not rolled back", config.Split.Canary, serviceName)
+	}
+	message := fmt.Sprintf("Restored canary version %s", config.Split.Canary)
+	logger.Warnf("%s of service %s", message, serviceName)
+	proxy.PublishEvent(Event{Type: EventCircuit, Service: serviceName, Message: message})
+	return nil
+}
+
+// Whether the canary version is rolled back, by service
+func (proxy *IsolationProxy) Canaries() map[string]bool {
+	proxy.configLock.Lock()
+	defer proxy.configLock.Unlock()
+	result := make(map[string]bool)
+	for service, config := range proxy.configs {
+		if config.Split != nil && config.Split.Canary != "" {
+			result[service] = config.Split.RolledBack()
+		}
+	}
+	return result
+}
+
+// GET returns Canaries(). POST and PUT reset the canary of the service in the
+// form value service, see ResetCanary().
+func (proxy *IsolationProxy) HandleCanaries() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST", "PUT":
+			if err := proxy.ResetCanary(r.FormValue("service")); err != nil {
+				services.Http_respond_error(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			services.Http_respond_error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		services.Http_respond_json(w, r, proxy.Canaries())
+	})
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+// A snapshot of the cumulative requests and errors of the endpoints of svc
+func testSnapshot(at time.Time, counts map[string][2]int) *snapshot {
+	endpoints := make(map[string]counters)
+	for name, count := range counts {
+		endpoints[name] = counters{reqs: uint(count[0]), errors: count[1]}
+	}
+	return &snapshot{time: at, services: map[string]map[string]counters{"svc": endpoints}}
+}
+
+func TestCanaryUsesWindowedErrorRates(t *testing.T) {
+	stable := testEndpoint("stable:1", state_active, 0, 0)
+	canary := testEndpoint("canary:1", state_active, 0, 0)
+	canary.Version = "canary"
+	registry := make(LocalRegistry)
+	registry.Add("svc", stable)
+	registry.Add("svc", canary)
+	p := NewIsolationProxyWithOptions(WithRegistry(registry))
+	split := &VersionSplit{Canary: "canary", MaxErrorRateDiff: 0.1, MinRequests: 10, Window: time.Minute}
+	p.Configure("svc").Split = split
+	events := p.events.subscribe()
+
+	start := time.Now()
+	check := func(offset time.Duration, counts map[string][2]int) {
+		now := testSnapshot(start.Add(offset), counts)
+		p.history.add(now)
+		p.checkCanaries(now)
+	}
+	// Errors of the canary before the window are ignored
+	check(0, map[string][2]int{"stable:1": {100, 0}, "canary:1": {100, 50}})
+	check(2*time.Minute, map[string][2]int{"stable:1": {200, 0}, "canary:1": {200, 50}})
+	if split.RolledBack() {
+		t.Fatalf("Canary rolled back because of errors before the window")
+	}
+	check(3*time.Minute, map[string][2]int{"stable:1": {300, 1}, "canary:1": {300, 70}})
+	if !split.RolledBack() || len(events) != 1 {
+		t.Fatalf("Canary not rolled back after errors in the window")
+	}
+	if event := <-events; event.Type != EventCircuit || event.Service != "svc" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	if err := p.ResetCanary("svc"); err != nil {
+		t.Fatal(err)
+	}
+	if canaries := p.Canaries(); len(canaries) != 1 || canaries["svc"] {
+		t.Errorf("Canary not restored: %v", canaries)
+	}
+	if err := p.ResetCanary("svc"); err == nil {
+		t.Errorf("No error resetting a canary that is not rolled back")
+	}
+	if err := p.ResetCanary("other"); err == nil {
+		t.Errorf("No error resetting the canary of an unknown service")
+	}
+}
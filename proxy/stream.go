@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Calls release once when the body is closed. The reverse proxy closes the body
+// after copying it to the client, or after the tunnel of an upgraded connection is closed.
+type trackedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (body *trackedBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.release)
+	return err
+}
+
+// The body of a 101 Switching Protocols response is also writable.
+// The reverse proxy relies on that to tunnel upgraded connections like WebSockets.
+type trackedUpgradeBody struct {
+	*trackedBody
+	io.Writer
+}
+
+func trackBody(body io.ReadCloser, release func()) io.ReadCloser {
+	tracked := &trackedBody{
+		ReadCloser: body,
+		release:    release,
+	}
+	if writer, ok := body.(io.Writer); ok {
+		return &trackedUpgradeBody{
+			trackedBody: tracked,
+			Writer:      writer,
+		}
+	}
+	return tracked
+}
+
+func isUpgrade(req *http.Request) bool {
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgraded connections, Server-Sent Events, and responses of unknown length of services
+// configured with a flush interval, see ServiceConfig.FlushInterval
+func isStreaming(resp *http.Response, flushInterval time.Duration) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return true
+	}
+	return flushInterval != 0 && resp.ContentLength < 0
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Serve the service through the complete handler of a proxy using the clock
+func newTestProxyServer(t *testing.T, clock Clock, endpoint *Endpoint, configure func(*ServiceConfig)) *httptest.Server {
+	registry := make(LocalRegistry)
+	registry.Add("svc", endpoint)
+	p := NewIsolationProxyWithOptions(WithRegistry(registry), WithClock(clock))
+	configure(p.Configure("svc"))
+	server := httptest.NewServer(p.Handler("svc"))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Switches to a protocol echoing every line, like a WebSocket server
+var echoUpgradeHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" {
+		http.Error(w, "Expected upgrade", http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	_ = rw.Flush()
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		_, _ = rw.WriteString(line)
+		_ = rw.Flush()
+	}
+})
+
+func TestUpgradedConnection(t *testing.T) {
+	backend := httptest.NewServer(echoUpgradeHandler)
+	defer backend.Close()
+	clock := newFakeClock()
+	endpoint := NewEndpoint("svc", hostOf(backend), WithEndpointClock(newFakeClock()))
+	server := newTestProxyServer(t, clock, endpoint, func(config *ServiceConfig) {
+		config.Timeout = time.Second
+	})
+
+	conn, err := net.Dial("tcp", hostOf(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /socket HTTP/1.1\r\nHost: svc\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected response to upgrade: %v", resp.Status)
+	}
+
+	// The tunnel outlives the deadline of the request
+	clock.Advance(time.Hour)
+	for _, message := range []string{"hello\n", "world\n"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if echo, err := reader.ReadString('\n'); err != nil || echo != message {
+			t.Fatalf("Echo %q, expected %q: %v", echo, message, err)
+		}
+	}
+	if load := endpoint.Load(); load != 1 {
+		t.Errorf("Load %v while the connection is upgraded", load)
+	}
+	_ = conn.Close()
+	eventually(t, "the load is released", func() bool { return endpoint.Load() == 0 })
+}
+
+func TestStreamedResponseIsFlushed(t *testing.T) {
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, chunk := range []string{"first\n", "second\n"} {
+			_, _ = w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer backend.Close()
+	defer close(next)
+	clock := newFakeClock()
+	endpoint := NewEndpoint("svc", hostOf(backend), WithEndpointClock(newFakeClock()))
+	server := newTestProxyServer(t, clock, endpoint, func(config *ServiceConfig) {
+		config.FlushInterval = 10 * time.Millisecond
+		config.Timeout = time.Second
+	})
+
+	resp, err := http.Get(server.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	// The backend only writes the second chunk after the first one was received
+	if chunk, err := reader.ReadString('\n'); err != nil || chunk != "first\n" {
+		t.Fatalf("First chunk %q: %v", chunk, err)
+	}
+	clock.Advance(time.Hour)
+	next <- struct{}{}
+	if chunk, err := reader.ReadString('\n'); err != nil || chunk != "second\n" {
+		t.Fatalf("Second chunk %q: %v", chunk, err)
+	}
+}
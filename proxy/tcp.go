@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// A client service connecting to a non-HTTP service (like Redis) through its own
+// local address. Every client gets an individual connection limit, so that one
+// client cannot exhaust the backends for all others.
+type TcpClient struct {
+	Name           string
+	Listen         string
+	MaxConnections int // No limit, if <= 0
+
+	lock      sync.Mutex
+	active    int
+	accepted  uint
+	rejected  uint
+	failovers uint
+}
+
+type TcpClientStats struct {
+	Listen         string
+	MaxConnections int
+	Active         int
+	Accepted       uint
+	Rejected       uint
+	Failovers      uint
+}
+
+// Forward raw TCP connections of the client to the endpoints of the service.
+// The endpoints are chosen like for HTTP requests. If connecting to an endpoint fails,
+// it is marked inactive and the next endpoint is tried. Established connections
+// cannot fail over, because the protocol state is unknown to the proxy.
+func (proxy *IsolationProxy) HandleTcp(serviceName string, client *TcpClient) error {
+	listener, err := net.Listen("tcp", client.Listen)
+	if err != nil {
+		return err
+	}
+	proxy.observe(serviceName)
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !client.acquire() {
+			logger.Warnf("Rejecting %s connection from %s: %d connections active", serviceName, client.Name, client.MaxConnections)
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			defer client.release()
+			proxy.forwardTcp(serviceName, client, conn)
+		}()
+	}
+}
+
+func (proxy *IsolationProxy) forwardTcp(serviceName string, client *TcpClient, conn net.Conn) {
+	defer conn.Close()
+	endpoints, err := proxy.Registry.Endpoints(serviceName)
+	if err != nil {
+		logger.Logf("Cannot forward %s connection from %s: %v", serviceName, client.Name, err)
+		return
+	}
+	for attempt := 0; attempt < len(endpoints); attempt++ {
+		endpoint := endpoints.Get()
+		if endpoint == nil {
+			endpoint = emergencyEndpoint(proxy.clock, endpoints)
+		}
+		if endpoint == nil {
+			break
+		}
+		start := endpoint.startRequest()
+		backend, err := proxy.dialer.Dial("tcp", endpoint.Host)
+		endpoint.finishRequest(start, err, err != nil)
+		if err != nil {
+			logger.Warnf("Error connecting %s to %v: %v. Will try other endpoint...", client.Name, endpoint, err)
+			client.count(&client.failovers)
+			continue
+		}
+		logger.Logf("Forwarding %s connection from %s to %v", serviceName, client.Name, endpoint)
+		pipe(conn, backend)
+		endpoint.releaseLoad()
+		return
+	}
+	logger.Logf("Cannot forward %s connection from %s: %v", serviceName, client.Name, noActiveEndpointsErr)
+}
+
+// Copy data in both directions until both sides finished sending. When one side
+// finished sending, only the writing half of the other connection is closed, so that
+// a client can still receive the response after half-closing its connection.
+func pipe(conn, backend net.Conn) {
+	defer backend.Close()
+	done := make(chan error, 2)
+	copyConn := func(to, from net.Conn) {
+		_, err := io.Copy(to, from)
+		if err == nil {
+			closeWrite(to)
+		}
+		done <- err
+	}
+	go copyConn(backend, conn)
+	go copyConn(conn, backend)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			return // Closing both connections stops the other direction
+		}
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	} else {
+		_ = conn.Close()
+	}
+}
+
+func (client *TcpClient) acquire() bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	if client.MaxConnections > 0 && client.active >= client.MaxConnections {
+		client.rejected++
+		return false
+	}
+	client.active++
+	client.accepted++
+	return true
+}
+
+func (client *TcpClient) release() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.active--
+}
+
+func (client *TcpClient) count(counter *uint) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	*counter++
+}
+
+func (client *TcpClient) Stats() *TcpClientStats {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return &TcpClientStats{
+		Listen:         client.Listen,
+		MaxConnections: client.MaxConnections,
+		Active:         client.active,
+		Accepted:       client.accepted,
+		Rejected:       client.rejected,
+		Failovers:      client.failovers,
+	}
+}
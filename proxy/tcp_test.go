@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// Answers every connection with the data received until the client half-closed it
+func newEchoBackend(t *testing.T) net.Listener {
+	listener := listen(t, "127.0.0.1:0")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, _ := ioutil.ReadAll(conn)
+				_, _ = conn.Write(request)
+			}()
+		}
+	}()
+	return listener
+}
+
+// Handle the TCP client in the background and wait until it accepts connections
+func handleTestTcp(t *testing.T, client *TcpClient, endpoint *Endpoint) {
+	registry := make(LocalRegistry)
+	registry.Add("svc", endpoint)
+	p := NewIsolationProxyWithOptions(WithRegistry(registry))
+	client.Listen = freeAddress(t)
+	go func() {
+		_ = p.HandleTcp("svc", client)
+	}()
+	eventually(t, "the client address is listening", func() bool {
+		conn, err := net.Dial("tcp", client.Listen)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	})
+	eventually(t, "the test connection is released", func() bool {
+		stats := client.Stats()
+		return stats.Accepted == 1 && stats.Active == 0
+	})
+}
+
+// Send the request, half-close the connection and return the response
+func tcpRequest(t *testing.T, conn net.Conn, request string) string {
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(response)
+}
+
+func TestTcpHalfClose(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+	client := &TcpClient{Name: "client"}
+	handleTestTcp(t, client, NewEndpoint("svc", backend.Addr().String()))
+
+	conn, err := net.Dial("tcp", client.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if response := tcpRequest(t, conn, "ping"); response != "ping" {
+		t.Errorf("Response %q after half-closing the connection", response)
+	}
+}
+
+func TestTcpMaxConnections(t *testing.T) {
+	backend := newEchoBackend(t)
+	defer backend.Close()
+	client := &TcpClient{Name: "client", MaxConnections: 1}
+	handleTestTcp(t, client, NewEndpoint("svc", backend.Addr().String()))
+
+	first, err := net.Dial("tcp", client.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	eventually(t, "the first connection is accepted", func() bool { return client.Stats().Active == 1 })
+	second, err := net.Dial("tcp", client.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if response, _ := ioutil.ReadAll(second); len(response) != 0 {
+		t.Errorf("Rejected connection received %q", response)
+	}
+	if response := tcpRequest(t, first, "ping"); response != "ping" {
+		t.Errorf("Response %q on the first connection", response)
+	}
+	eventually(t, "the first connection is released", func() bool { return client.Stats().Active == 0 })
+	if stats := client.Stats(); stats.Rejected != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
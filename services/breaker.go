@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	default_breaker_failures  = 5
+	default_breaker_open_time = 5 * time.Second
+)
+
+// Returned by a CircuitBreaker instead of calling an operation while its circuit is open
+type CircuitOpenError struct {
+	Operation  string
+	RetryAfter time.Time
+}
+
+func (err *CircuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit for %v is open, retry in %v", err.Operation, err.RetryAfter.Sub(time.Now()))
+}
+
+type BreakerThreshold struct {
+	// Consecutive failures that open the circuit, default_breaker_failures if zero
+	Failures int
+
+	// Calls fail fast for this time after the circuit opened, then one trial call
+	// decides whether it closes again. default_breaker_open_time if zero.
+	OpenTime time.Duration
+}
+
+// Fails calls of operations that failed repeatedly with a CircuitOpenError, without
+// waiting for the remote service. Errors count as failures, except for HttpStatusErrors
+// below 500, which are answers of a working service, and errors while the context of the
+// call is cancelled or expired, which are caused by the caller. A nil breaker calls all operations.
+type CircuitBreaker struct {
+	Default BreakerThreshold
+
+	// Per operation, must not be changed after the first call
+	Thresholds map[string]BreakerThreshold
+
+	lock     sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	trial     bool // A trial call is running in the open circuit
+}
+
+func (breaker *CircuitBreaker) threshold(operation string) BreakerThreshold {
+	threshold, ok := breaker.Thresholds[operation]
+	if !ok {
+		threshold = breaker.Default
+	}
+	if threshold.Failures <= 0 {
+		threshold.Failures = default_breaker_failures
+	}
+	if threshold.OpenTime <= 0 {
+		threshold.OpenTime = default_breaker_open_time
+	}
+	return threshold
+}
+
+// The context must be the one used by the call
+func (breaker *CircuitBreaker) Call(ctx context.Context, operation string, call func() error) error {
+	if breaker == nil {
+		return call()
+	}
+	if err := breaker.enter(operation); err != nil {
+		return err
+	}
+	err := call()
+	breaker.leave(operation, isFailure(ctx, err), err)
+	return err
+}
+
+func (breaker *CircuitBreaker) enter(operation string) error {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	c := breaker.circuits[operation]
+	if c == nil || c.failures < breaker.threshold(operation).Failures {
+		return nil
+	}
+	if c.trial || time.Now().Before(c.openUntil) {
+		return &CircuitOpenError{Operation: operation, RetryAfter: c.openUntil}
+	}
+	c.trial = true
+	return nil
+}
+
+func (breaker *CircuitBreaker) leave(operation string, failed bool, err error) {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	if breaker.circuits == nil {
+		breaker.circuits = make(map[string]*circuit)
+	}
+	c := breaker.circuits[operation]
+	if c == nil {
+		c = new(circuit)
+		breaker.circuits[operation] = c
+	}
+	c.trial = false
+	if !failed {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if threshold := breaker.threshold(operation); c.failures >= threshold.Failures {
+		if c.failures == threshold.Failures {
+			L.Warnf("Opening circuit for %v after %v failures, last: %v", operation, c.failures, err)
+		}
+		c.openUntil = time.Now().Add(threshold.OpenTime)
+	}
+}
+
+func isFailure(ctx context.Context, err error) bool {
+	// Client.Do() returns the plain context.DeadlineExceeded for requests it did not send
+	// because the deadline of the context has (almost) passed
+	if err == nil || err == context.DeadlineExceeded || errors.Is(err, context.Canceled) || ctx.Err() != nil {
+		return false
+	}
+	if statusErr, ok := err.(*HttpStatusError); ok {
+		return statusErr.Code >= 500
+	}
+	return true
+}
+
+// Return the time to wait before retrying, if the error was caused by an open circuit
+func CircuitOpen(err error) (time.Time, bool) {
+	if openErr, ok := err.(*CircuitOpenError); ok {
+		return openErr.RetryAfter, true
+	}
+	return time.Time{}, false
+}
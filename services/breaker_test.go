@@ -0,0 +1,85 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAndCloses(t *testing.T) {
+	breaker := &CircuitBreaker{
+		Default:    BreakerThreshold{Failures: 2, OpenTime: time.Hour},
+		Thresholds: map[string]BreakerThreshold{"fast": {Failures: 1, OpenTime: 10 * time.Millisecond}},
+	}
+	failure := errors.New("failure")
+	fail := func() error { return failure }
+	succeed := func() error { return nil }
+
+	for i := 0; i < 2; i++ {
+		if err := breaker.Call(context.Background(), "slow", fail); err != failure {
+			t.Fatalf("Unexpected error of failing call %v: %v", i, err)
+		}
+	}
+	if _, open := CircuitOpen(breaker.Call(context.Background(), "slow", succeed)); !open {
+		t.Error("Circuit did not open after 2 failures")
+	}
+
+	if err := breaker.Call(context.Background(), "fast", fail); err != failure {
+		t.Fatalf("Unexpected error of failing call: %v", err)
+	}
+	if _, open := CircuitOpen(breaker.Call(context.Background(), "fast", succeed)); !open {
+		t.Error("Circuit with own threshold did not open after 1 failure")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := breaker.Call(context.Background(), "fast", succeed); err != nil {
+		t.Errorf("Trial call failed: %v", err)
+	}
+	if err := breaker.Call(context.Background(), "fast", succeed); err != nil {
+		t.Errorf("Circuit did not close after successful trial: %v", err)
+	}
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	breaker := &CircuitBreaker{Default: BreakerThreshold{Failures: 1}}
+	conflict := &HttpStatusError{Code: http.StatusConflict}
+	for i := 0; i < 3; i++ {
+		if err := breaker.Call(context.Background(), "op", func() error { return conflict }); err != conflict {
+			t.Errorf("Unexpected error of call %v: %v", i, err)
+		}
+	}
+	var nilBreaker *CircuitBreaker
+	if err := nilBreaker.Call(context.Background(), "op", func() error { return conflict }); err != conflict {
+		t.Errorf("Unexpected error of nil breaker: %v", err)
+	}
+}
+
+func TestCircuitBreakerIgnoresCallerContext(t *testing.T) {
+	breaker := &CircuitBreaker{Default: BreakerThreshold{Failures: 1}}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	client := new(Client)
+	for i := 0; i < 3; i++ {
+		err := breaker.Call(cancelled, "op", func() error {
+			_, err := client.Do(cancelled, "GET", "http://127.0.0.1:1/", nil)
+			return err
+		})
+		if _, open := CircuitOpen(err); err == nil || open {
+			t.Fatalf("Unexpected error of cancelled call %v: %v", i, err)
+		}
+		if err := breaker.Call(expired, "op", func() error {
+			_, err := client.Do(expired, "GET", "http://127.0.0.1:1/", nil)
+			return err
+		}); err != context.DeadlineExceeded {
+			t.Fatalf("Unexpected error of call with expired deadline %v: %v", i, err)
+		}
+	}
+	failure := errors.New("failure")
+	_ = breaker.Call(context.Background(), "op", func() error { return failure })
+	if _, open := CircuitOpen(breaker.Call(context.Background(), "op", func() error { return nil })); !open {
+		t.Error("Circuit did not open after failure with a live context")
+	}
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	default_client_timeout = 10 * time.Second
+	default_client_retries = 2
+	default_client_backoff = 50 * time.Millisecond
+)
+
+// Used by the Http_get_json and Http_post_string style helpers and the API packages of the services
+var DefaultClient = &Client{
+	Timeout: default_client_timeout,
+	Retries: default_client_retries,
+	Backoff: default_client_backoff,
+}
+
+// Wraps every attempt of a request sent by a Client, e.g. to add headers or record metrics
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Sends requests to other services. Contexts cancel requests and their deadlines are
+// forwarded in the DeadlineHeader. If the deadline has already passed, no request is sent.
+// Timeout, Middleware and Transport must be configured before the first request.
+type Client struct {
+	// For every attempt, including reading the response body. No timeout if zero.
+	Timeout time.Duration
+
+	// Additional attempts for idempotent requests that failed to connect or
+	// received 502, 503 or 504. The wait before the first retry is Backoff,
+	// doubled for every further retry.
+	Retries int
+	Backoff time.Duration
+
+	// Added to every request
+	Header http.Header
+
+	// The first middleware sees the request first
+	Middleware []Middleware
+
+	// http.DefaultTransport if nil
+	Transport http.RoundTripper
+
+	httpOnce   sync.Once
+	httpClient *http.Client // Built with the middleware chain by the first request
+}
+
+// Must be called before the first request, later middleware is ignored
+func (client *Client) Use(middleware ...Middleware) {
+	client.Middleware = append(client.Middleware, middleware...)
+}
+
+func (client *Client) getHttpClient() *http.Client {
+	client.httpOnce.Do(func() {
+		client.httpClient = &http.Client{
+			Timeout:   client.Timeout,
+			Transport: client.transport(),
+		}
+	})
+	return client.httpClient
+}
+
+func (client *Client) transport() http.RoundTripper {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	for i := len(client.Middleware) - 1; i >= 0; i-- {
+		transport = client.Middleware[i](transport)
+	}
+	return transport
+}
+
+// Send a request with the form as body, or without body if form is nil.
+// Idempotent requests are retried, see Client.Retries.
+func (client *Client) Do(ctx context.Context, method, the_url string, form url.Values) (*http.Response, error) {
+	httpClient := client.getHttpClient()
+	retries := 0
+	if idempotent(method) {
+		retries = client.Retries
+	}
+	backoff := client.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := client.newRequest(ctx, method, the_url, form)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := httpClient.Do(req)
+		if attempt >= retries || ctx.Err() != nil || !retryable(resp, err) {
+			return resp, err
+		}
+		if err == nil {
+			err = &HttpStatusError{URL: req.URL.String(), Code: resp.StatusCode, Status: resp.Status}
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		L.Tracef("Retrying %v %v in %v: %v", method, the_url, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (client *Client) newRequest(ctx context.Context, method, the_url string, form url.Values) (*http.Request, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, the_url, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range client.Header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if id := RequestID(ctx); id != "" && req.Header.Get(RequestIDHeader) == "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	if deadline, ok := ctx.Deadline(); ok && !SetDeadlineHeader(req.Header, deadline) {
+		return nil, context.DeadlineExceeded
+	}
+	return req.WithContext(ctx), nil
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (client *Client) GetJson(ctx context.Context, the_url string, result interface{}) error {
+	resp, err := client.Do(ctx, "GET", the_url, nil)
+	if err == nil {
+		defer resp.Body.Close()
+	}
+	data, err := Http_check_response(resp, err, the_url)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
+
+func (client *Client) GetJsonMap(ctx context.Context, the_url string, requiredKeys ...string) (map[string]interface{}, error) {
+	var result interface{}
+	if err := client.GetJson(ctx, the_url, &result); err != nil {
+		return nil, err
+	}
+	return checkJsonMap(result, requiredKeys...)
+}
+
+// Send a POST request without form data and ignore the response body
+func (client *Client) Post(ctx context.Context, the_url string) error {
+	_, err := client.PostString(ctx, the_url, url.Values{})
+	return err
+}
+
+func (client *Client) PostString(ctx context.Context, the_url string, form url.Values) (string, error) {
+	resp, err := client.Do(ctx, "POST", the_url, form)
+	if err == nil {
+		defer resp.Body.Close()
+	}
+	data, err := Http_check_response(resp, err, the_url)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
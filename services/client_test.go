@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Responds with 503 to the first failures requests
+func unavailableServer(failures int32) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"method": "` + r.Method + `"}`))
+	}))
+	return server, &requests
+}
+
+func TestClientRetriesIdempotentRequests(t *testing.T) {
+	server, requests := unavailableServer(2)
+	defer server.Close()
+	client := &Client{Retries: 2}
+
+	result, err := client.GetJsonMap(context.Background(), server.URL, "method")
+	if err != nil || result["method"] != "GET" || atomic.LoadInt32(requests) != 3 {
+		t.Errorf("Unexpected result after %v requests: %v, %v", atomic.LoadInt32(requests), result, err)
+	}
+}
+
+func TestClientDoesNotRetryPost(t *testing.T) {
+	server, requests := unavailableServer(1)
+	defer server.Close()
+	client := &Client{Retries: 2}
+
+	_, err := client.PostString(context.Background(), server.URL, nil)
+	if statusErr, ok := err.(*HttpStatusError); !ok || statusErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if count := atomic.LoadInt32(requests); count != 1 {
+		t.Errorf("POST request sent %v times", count)
+	}
+}
+
+func TestClientHeadersAndMiddleware(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Default") + "," + r.Header.Get("X-Order")))
+	}))
+	defer server.Close()
+	addOrder := func(name string) Middleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				req.Header.Add("X-Order", name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	client := &Client{Header: http.Header{"X-Default": {"value"}}}
+	client.Use(addOrder("first"), addOrder("second"))
+
+	body, err := client.PostString(context.Background(), server.URL, nil)
+	if err != nil || body != "value,first" {
+		t.Errorf("Unexpected response: %v, %v", body, err)
+	}
+}
+
+func TestClientBuildsMiddlewareOnce(t *testing.T) {
+	server, _ := unavailableServer(0)
+	defer server.Close()
+	var built int32
+	client := &Client{}
+	client.Use(func(next http.RoundTripper) http.RoundTripper {
+		atomic.AddInt32(&built, 1)
+		return next
+	})
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetJsonMap(context.Background(), server.URL, "method"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := atomic.LoadInt32(&built); count != 1 {
+		t.Errorf("Middleware built %v times", count)
+	}
+}
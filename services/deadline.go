@@ -0,0 +1,58 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Carries the remaining time budget of a request between services, formatted like
+// time.Duration (e.g. "850ms"). A relative value avoids depending on synchronized clocks.
+// Every hop converts it to an absolute deadline on arrival and writes the then
+// remaining budget on outgoing requests.
+const DeadlineHeader = "X-Request-Deadline"
+
+// Return the deadline contained in the request header, if any
+func RequestDeadline(r *http.Request) (time.Time, bool) {
+	value := r.Header.Get(DeadlineHeader)
+	if value == "" {
+		return time.Time{}, false
+	}
+	budget, err := time.ParseDuration(value)
+	if err != nil {
+		L.Tracef("Ignoring illegal %s header '%s': %v", DeadlineHeader, value, err)
+		return time.Time{}, false
+	}
+	return time.Now().Add(budget), true
+}
+
+// Store the remaining time until the deadline in the header.
+// Return false, if the deadline has already passed.
+func SetDeadlineHeader(header http.Header, deadline time.Time) bool {
+	budget := deadline.Sub(time.Now())
+	if budget <= 0 {
+		return false
+	}
+	header.Set(DeadlineHeader, budget.String())
+	return true
+}
+
+// Attach the deadline in the request header to the request context, so that
+// outgoing requests made with that context forward the remaining budget.
+// Requests arriving with an exhausted budget are answered with 504 Gateway Timeout.
+func PropagateDeadline(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok := RequestDeadline(r)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !deadline.After(time.Now()) {
+			Http_respond_error(w, r, "Request deadline exceeded", http.StatusGatewayTimeout)
+			return
+		}
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -2,30 +2,36 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
-	"sync"
 
-	"github.com/go-ini/ini"
 	"github.com/gorilla/mux"
 )
 
 var (
-	response_logger = Logger{Prefix: "HTTP "}
+	response_logger = Component("http")
 	PrettyJson      = true
 )
 
+func init() {
+	response_logger.Enable(LevelOff)
+}
+
+// Log all responses with the level of L, see also HandleLogLevels()
 func EnableResponseLogging() {
-	response_logger.Enable(L.Level)
+	response_logger.InheritLevel()
 }
 
 func Http_respond_json(w http.ResponseWriter, r *http.Request, value interface{}) {
+	Http_respond_json_status(w, r, value, http.StatusOK)
+}
+
+func Http_respond_json_status(w http.ResponseWriter, r *http.Request, value interface{}, code int) {
 	var result []byte
 	var err error
 	if PrettyJson {
@@ -36,7 +42,7 @@ func Http_respond_json(w http.ResponseWriter, r *http.Request, value interface{}
 	if err != nil {
 		Http_respond_error(w, r, "Failed to marshal response data: "+err.Error(), http.StatusInternalServerError)
 	} else {
-		Http_respond(w, r, result, http.StatusOK)
+		Http_respond(w, r, result, code)
 	}
 }
 
@@ -45,7 +51,11 @@ func http_log(r *http.Request, code int, note string) {
 		if note != "" {
 			note = ": " + note
 		}
-		response_logger.Logf("%v: %v, %v%s", r.URL, code, http.StatusText(code), note)
+		fields := Fields{"method": r.Method, "url": r.URL, "status": code}
+		if id := RequestID(r.Context()); id != "" {
+			fields["request_id"] = id
+		}
+		response_logger.With(fields).Logf("%v%s", http.StatusText(code), note)
 	}
 }
 
@@ -54,6 +64,16 @@ func Http_respond_error(w http.ResponseWriter, r *http.Request, err string, code
 	http.Error(w, err, code)
 }
 
+// Like Http_respond_error, but the body is a JSON object with the message in the "error" key
+func Http_respond_json_error(w http.ResponseWriter, r *http.Request, err string, code int) {
+	http_log(r, code, err)
+	data, _ := json.Marshal(map[string]string{"error": err})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
 // This is a way for the application to control the http response code, if the controller
 // is willing to evaluate it
 type HttpError struct {
@@ -159,6 +179,10 @@ func Http_json_map_response(_response *http.Response, err error, url string, req
 	if err != nil {
 		return nil, err
 	}
+	return checkJsonMap(response, requiredKeys...)
+}
+
+func checkJsonMap(response interface{}, requiredKeys ...string) (map[string]interface{}, error) {
 	obj, ok := response.(map[string]interface{})
 	if !ok {
 		return nil, fmt.Errorf("JSON response is not an object: %v", response)
@@ -172,32 +196,37 @@ func Http_json_map_response(_response *http.Response, err error, url string, req
 }
 
 func Http_get_json_map(the_url string, requiredKeys ...string) (map[string]interface{}, error) {
-	the_url = loadBalanceUrl(the_url)
-	resp, err := http.Get(the_url)
-	return Http_json_map_response(resp, err, the_url, requiredKeys...)
+	return Http_get_json_map_ctx(context.Background(), the_url, requiredKeys...)
 }
 
 func Http_get_json(the_url string, result interface{}) error {
-	the_url = loadBalanceUrl(the_url)
-	resp, err := http.Get(the_url)
-	return Http_json_response(resp, err, the_url, &result)
+	return Http_get_json_ctx(context.Background(), the_url, result)
 }
 
 func Http_simple_post(the_url string) error {
-	the_url = loadBalanceUrl(the_url)
-	resp, err := http.PostForm(the_url, nil)
-	_, err = Http_check_response(resp, err, the_url)
-	return err
+	return Http_simple_post_ctx(context.Background(), the_url)
 }
 
 func Http_post_string(the_url string, data url.Values) (string, error) {
-	the_url = loadBalanceUrl(the_url)
-	resp, err := http.PostForm(the_url, data)
-	if data, err := Http_check_response(resp, err, the_url); err != nil {
-		return "", err
-	} else {
-		return string(data), nil
-	}
+	return Http_post_string_ctx(context.Background(), the_url, data)
+}
+
+// The _ctx variants use DefaultClient, see Client.
+
+func Http_get_json_map_ctx(ctx context.Context, the_url string, requiredKeys ...string) (map[string]interface{}, error) {
+	return DefaultClient.GetJsonMap(ctx, the_url, requiredKeys...)
+}
+
+func Http_get_json_ctx(ctx context.Context, the_url string, result interface{}) error {
+	return DefaultClient.GetJson(ctx, the_url, result)
+}
+
+func Http_simple_post_ctx(ctx context.Context, the_url string) error {
+	return DefaultClient.Post(ctx, the_url)
+}
+
+func Http_post_string_ctx(ctx context.Context, the_url string, data url.Values) (string, error) {
+	return DefaultClient.PostString(ctx, the_url, data)
 }
 
 func MakeHttpResponse(req *http.Request, code int, bodyContent string) *http.Response {
@@ -219,80 +248,3 @@ func MakeHttpResponse(req *http.Request, code int, bodyContent string) *http.Res
 		TLS:              nil,
 	}
 }
-
-// =========================== HACK: dirty load-balancing mechanism for experiments
-
-type balancedEndpoint struct {
-	endpoints []string
-	next      uint
-	lock      sync.Mutex
-}
-
-var balancedEndpoints map[string]*balancedEndpoint
-var balancedEndpointsConfig string
-var balancedEndpointsParsed bool
-var balancedEndpointsLock sync.Mutex
-
-func ParseBalanceEndpointsFlags() {
-	balancedEndpoints = make(map[string]*balancedEndpoint)
-	flag.StringVar(&balancedEndpointsConfig, "balancedEndpoints", "",
-		"ini-file containing mappings from host:port to a list of host:port to be used instead")
-}
-
-func ParseLoadBalanceConfig() {
-	if !balancedEndpointsParsed {
-		balancedEndpointsLock.Lock()
-		defer balancedEndpointsLock.Unlock()
-		if !balancedEndpointsParsed {
-			balancedEndpointsParsed = true
-			if balancedEndpointsConfig == "" {
-				return // No configuration given
-			}
-			confIni, err := ini.Load(balancedEndpointsConfig)
-			if err != nil {
-				log.Fatalf("Error loading load balancing config file %v: %v\n", balancedEndpointsConfig, err)
-			}
-			section, err := confIni.GetSection("")
-			if err != nil {
-				log.Fatalf("Error getting default section from load balancing config file %v: %v\n", balancedEndpointsConfig, err)
-			}
-			for _, endpoint := range section.Keys() {
-				balancedEndpoints[endpoint.Name()] = &balancedEndpoint{
-					endpoints: endpoint.Strings(","),
-				}
-			}
-			if len(balancedEndpoints) == 0 {
-				log.Fatalf("Load balancing config file did not contain any entries: %v\n", balancedEndpointsConfig)
-			}
-			if L.LevelEnabled(LevelNormal) {
-				L.Logf("Ad-hoc load balancing enabled for:")
-				for host, endpoint := range balancedEndpoints {
-					L.Logf("%v => %v", host, endpoint.endpoints)
-				}
-			}
-		}
-	}
-}
-
-func loadBalanceUrl(url_str string) string {
-	if balancedEndpointsConfig == "" {
-		return url_str
-	}
-	ParseLoadBalanceConfig()
-	new_url, err := url.Parse(url_str)
-	if err != nil {
-		// Error should pop up elsewhere
-		return url_str
-	}
-	if endpoint, ok := balancedEndpoints[new_url.Host]; ok {
-		endpoint.lock.Lock()
-		defer endpoint.lock.Unlock()
-		host := endpoint.endpoints[endpoint.next]
-		endpoint.next++
-		endpoint.next = endpoint.next % uint(len(endpoint.endpoints))
-		new_url.Host = host
-		return new_url.String()
-	} else {
-		return url_str
-	}
-}
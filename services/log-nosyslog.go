@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package services
+
+import "errors"
+
+// Syslog is not supported on this platform
+func LogToSyslog(tag string) error {
+	return errors.New("Logging to syslog is not supported on this platform")
+}
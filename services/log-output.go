@@ -0,0 +1,221 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogFormat string
+
+const (
+	// Like the standard log package: time, level name and message, followed by the fields
+	FormatText = LogFormat("text")
+
+	// One JSON object per line with the keys time, level, msg, component and the fields
+	FormatJSON = LogFormat("json")
+
+	// Like FormatJSON, but as key=value pairs
+	FormatLogfmt = LogFormat("logfmt")
+)
+
+const text_time_format = "2006/01/02 15:04:05"
+
+var sink = &logSink{
+	format: FormatText,
+	out:    os.Stdout,
+}
+
+func ParseLogFormat(format string) (LogFormat, error) {
+	switch result := LogFormat(format); result {
+	case FormatText, FormatJSON, FormatLogfmt:
+		return result, nil
+	default:
+		return "", fmt.Errorf("Unknown log format: %v", format)
+	}
+}
+
+type logEntry struct {
+	time      time.Time
+	level     LogLevel
+	msg       string
+	component string
+	fields    Fields
+}
+
+// Shared by all loggers
+type logSink struct {
+	lock   sync.Mutex
+	format LogFormat
+	out    io.Writer
+	syslog syslogWriter // Replaces out if not nil, see LogToSyslog()
+}
+
+// Implemented by *syslog.Writer
+type syslogWriter interface {
+	Err(m string) error
+	Warning(m string) error
+	Info(m string) error
+	Debug(m string) error
+}
+
+func SetLogFormat(format LogFormat) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.format = format
+}
+
+func SetLogOutput(out io.Writer) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.out = out
+	sink.syslog = nil
+}
+
+func LogToFile(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	SetLogOutput(file)
+	return nil
+}
+
+func (sink *logSink) write(entry *logEntry) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	withTime := sink.syslog == nil // Syslog adds its own timestamp
+	var line string
+	switch sink.format {
+	case FormatJSON:
+		line = entry.json(withTime)
+	case FormatLogfmt:
+		line = entry.logfmt(withTime)
+	default:
+		line = entry.text(withTime)
+	}
+	if sink.syslog == nil {
+		_, _ = io.WriteString(sink.out, line+"\n")
+		return
+	}
+	switch {
+	case entry.level >= LevelError:
+		_ = sink.syslog.Err(line)
+	case entry.level >= LevelWarn:
+		_ = sink.syslog.Warning(line)
+	case entry.level >= LevelNormal:
+		_ = sink.syslog.Info(line)
+	default:
+		_ = sink.syslog.Debug(line)
+	}
+}
+
+// All fields, including the component
+func (entry *logEntry) allFields() Fields {
+	if entry.component == "" {
+		return entry.fields
+	}
+	fields := Fields{"component": entry.component}
+	for key, value := range entry.fields {
+		fields[key] = value
+	}
+	return fields
+}
+
+func (entry *logEntry) text(withTime bool) string {
+	var buf bytes.Buffer
+	if withTime {
+		buf.WriteString(entry.time.Format(text_time_format) + " ")
+	}
+	buf.WriteString(entry.level.Name() + ": " + entry.msg)
+	fields := entry.allFields()
+	for _, key := range sortedKeys(fields) {
+		buf.WriteString(" " + key + "=" + logfmtValue(fields[key]))
+	}
+	return buf.String()
+}
+
+func (entry *logEntry) logfmt(withTime bool) string {
+	var buf bytes.Buffer
+	if withTime {
+		buf.WriteString("time=" + entry.time.Format(time.RFC3339Nano) + " ")
+	}
+	buf.WriteString("level=" + strings.ToLower(entry.level.String()) + " msg=" + logfmtValue(entry.msg))
+	fields := entry.allFields()
+	for _, key := range sortedKeys(fields) {
+		buf.WriteString(" " + key + "=" + logfmtValue(fields[key]))
+	}
+	return buf.String()
+}
+
+func (entry *logEntry) json(withTime bool) string {
+	obj := make(map[string]interface{}, len(entry.fields)+4)
+	for key, value := range entry.allFields() {
+		obj[key] = jsonValue(value)
+	}
+	if withTime {
+		obj["time"] = entry.time.Format(time.RFC3339Nano)
+	}
+	obj["level"] = strings.ToLower(entry.level.String())
+	obj["msg"] = entry.msg
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Sprintf(`{"level": "error", "msg": %q}`, "Failed to encode log line: "+err.Error())
+	}
+	return string(data)
+}
+
+// Errors and fmt.Stringers would otherwise be encoded as objects
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func logfmtValue(value interface{}) string {
+	str := fmt.Sprint(value)
+	if str == "" || strings.ContainsAny(str, " =\"\t\n") {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+// flag.Value for the format of all loggers
+type formatFlag struct{}
+
+func (formatFlag) String() string {
+	return string(FormatText)
+}
+
+func (formatFlag) Set(value string) error {
+	format, err := ParseLogFormat(value)
+	if err == nil {
+		SetLogFormat(format)
+	}
+	return err
+}
+
+// flag.Value for the output of all loggers
+type outputFlag struct{}
+
+func (outputFlag) String() string {
+	return ""
+}
+
+func (outputFlag) Set(value string) error {
+	if value == "syslog" {
+		return LogToSyslog("")
+	}
+	return LogToFile(value)
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package services
+
+import "log/syslog"
+
+// The levels of the log lines are mapped to syslog priorities
+func LogToSyslog(tag string) error {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return err
+	}
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.syslog = writer
+	return nil
+}
@@ -3,22 +3,34 @@ package services
 import (
 	"flag"
 	"fmt"
-	"log"
-	"os"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	L = NewLogger(LevelNormal)
+
+	components     = make(map[string]*Logger)
+	componentsLock sync.Mutex
+
+	// Protects Logger.Level, so that levels can be changed concurrently to logging
+	levelLock sync.RWMutex
 )
 
 func init() {
-	msg := fmt.Sprintf("Loglevel: %v=%d, %v=%d, %v=%d, %v=%d",
+	msg := fmt.Sprintf("Loglevel: %v=%d, %v=%d, %v=%d, %v=%d, %v=%d (or the name of the level)",
 		LevelOff, LevelOff,
 		LevelTrace, LevelTrace,
 		LevelNormal, LevelNormal,
-		LevelWarn, LevelWarn)
-	flag.IntVar((*int)(&(L.Level)), "loglevel", int(LevelNormal), msg)
+		LevelWarn, LevelWarn,
+		LevelError, LevelError)
+	flag.Var(levelFlag{L}, "loglevel", msg)
+	flag.Var(formatFlag{}, "logformat", "Format of log lines: text, json or logfmt")
+	flag.Var(outputFlag{}, "logfile", "Append log lines to this file instead of stdout, or 'syslog'")
 }
 
 type LogLevel int
@@ -28,6 +40,10 @@ const (
 	LevelTrace  = LogLevel(5)
 	LevelNormal = LogLevel(10)
 	LevelWarn   = LogLevel(15)
+	LevelError  = LogLevel(20)
+
+	// Use the level of the parent logger, see With() and Component()
+	levelInherit = LogLevel(-1)
 )
 
 var (
@@ -36,6 +52,7 @@ var (
 		LevelTrace:  "Trace",
 		LevelNormal: "  Log",
 		LevelWarn:   " Warn",
+		LevelError:  "Error",
 	}
 )
 
@@ -51,10 +68,36 @@ func (level LogLevel) String() string {
 	return strings.TrimSpace(level.Name())
 }
 
+// Accepts the numbers and names of the levels, case insensitive
+func ParseLogLevel(value string) (LogLevel, error) {
+	if number, err := strconv.Atoi(value); err == nil {
+		return LogLevel(number), nil
+	}
+	for level := range LevelNames {
+		if strings.EqualFold(level.String(), value) {
+			return level, nil
+		}
+	}
+	if strings.EqualFold(value, "normal") {
+		return LevelNormal, nil
+	}
+	return 0, fmt.Errorf("Unknown log level: %v", value)
+}
+
+// Structured data added to log lines, see Logger.With()
+type Fields map[string]interface{}
+
+// A zero Logger is disabled
 type Logger struct {
-	Prefix string
-	Level  LogLevel
-	logger *log.Logger
+	Prefix    string
+	Component string // Added to all lines as the "component" field
+
+	// Negative to use the level of the parent logger, see EffectiveLevel().
+	// Use Enable() to change it concurrently to logging.
+	Level LogLevel
+
+	fields Fields
+	parent *Logger
 }
 
 func NewLogger(level LogLevel) *Logger {
@@ -63,24 +106,90 @@ func NewLogger(level LogLevel) *Logger {
 	return logger
 }
 
-func (logger *Logger) Enable(level LogLevel) {
-	if logger.logger == nil {
-		logger.logger = log.New(os.Stdout, "", log.LstdFlags)
+// Return the logger of a component of the application, e.g. "proxy" or "redis".
+// The level of a component follows the level of L until it is changed.
+func Component(name string) *Logger {
+	componentsLock.Lock()
+	defer componentsLock.Unlock()
+	logger, ok := components[name]
+	if !ok {
+		logger = &Logger{
+			Component: name,
+			parent:    L,
+			Level:     levelInherit,
+		}
+		components[name] = logger
 	}
+	return logger
+}
+
+// Return a logger adding the fields to every line. It shares the level of this logger.
+func (logger *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(logger.fields)+len(fields))
+	for key, value := range logger.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Logger{
+		Prefix:    logger.Prefix,
+		Component: logger.Component,
+		fields:    merged,
+		parent:    logger,
+		Level:     levelInherit,
+	}
+}
+
+func (logger *Logger) Enable(level LogLevel) {
+	levelLock.Lock()
+	defer levelLock.Unlock()
 	logger.Level = level
 }
 
+// Use the level of the parent logger again, if any
+func (logger *Logger) InheritLevel() {
+	if logger.parent != nil {
+		logger.Enable(levelInherit)
+	}
+}
+
+// The level of the logger, or of its parent if it inherits the level
+func (logger *Logger) EffectiveLevel() LogLevel {
+	levelLock.RLock()
+	defer levelLock.RUnlock()
+	for ; logger != nil; logger = logger.parent {
+		if logger.Level >= LevelOff {
+			return logger.Level
+		}
+	}
+	return LevelOff
+}
+
+func (logger *Logger) inherited() bool {
+	levelLock.RLock()
+	defer levelLock.RUnlock()
+	return logger.Level < LevelOff
+}
+
 func (logger *Logger) Enabled() bool {
-	return logger != nil && logger.logger != nil && logger.Level > LevelOff
+	return logger.EffectiveLevel() > LevelOff
 }
 
 func (logger *Logger) LevelEnabled(level LogLevel) bool {
-	return logger != nil && logger.logger != nil && logger.Level != LevelOff && level >= logger.Level
+	current := logger.EffectiveLevel()
+	return current != LevelOff && level >= current
 }
 
-func (logger *Logger) LogLevelf(level LogLevel, fmt string, v ...interface{}) {
+func (logger *Logger) LogLevelf(level LogLevel, fmt_str string, v ...interface{}) {
 	if logger.LevelEnabled(level) {
-		logger.logger.Printf(level.Name()+": "+logger.Prefix+fmt+"\n", v...)
+		sink.write(&logEntry{
+			time:      time.Now(),
+			level:     level,
+			msg:       logger.Prefix + fmt.Sprintf(fmt_str, v...),
+			component: logger.Component,
+			fields:    logger.fields,
+		})
 	}
 }
 
@@ -95,3 +204,100 @@ func (logger *Logger) Logf(fmt string, v ...interface{}) {
 func (logger *Logger) Warnf(fmt string, v ...interface{}) {
 	logger.LogLevelf(LevelWarn, fmt, v...)
 }
+
+func (logger *Logger) Errorf(fmt string, v ...interface{}) {
+	logger.LogLevelf(LevelError, fmt, v...)
+}
+
+// Return the levels of L (as "default") and all component loggers, "inherit" for
+// components following the level of L
+func LogLevels() map[string]string {
+	componentsLock.Lock()
+	defer componentsLock.Unlock()
+	result := map[string]string{"default": L.EffectiveLevel().String()}
+	for name, logger := range components {
+		if logger.inherited() {
+			result[name] = "inherit"
+		} else {
+			result[name] = logger.EffectiveLevel().String()
+		}
+	}
+	return result
+}
+
+// Change the level of L (component "" or "default") or of an existing component logger.
+// The level "inherit" lets a component follow the level of L again.
+func SetLogLevel(component string, value string) error {
+	logger := L
+	if component != "" && component != "default" {
+		componentsLock.Lock()
+		logger = components[component]
+		componentsLock.Unlock()
+		if logger == nil {
+			return fmt.Errorf("Unknown log component: %v", component)
+		}
+	}
+	if strings.EqualFold(value, "inherit") && logger != L {
+		logger.InheritLevel()
+		return nil
+	}
+	level, err := ParseLogLevel(value)
+	if err != nil {
+		return err
+	}
+	logger.Enable(level)
+	return nil
+}
+
+// GET returns LogLevels(). POST and PUT change a level with the form values
+// component (optional) and level, see SetLogLevel().
+func HandleLogLevels() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST", "PUT":
+			component, level := r.FormValue("component"), r.FormValue("level")
+			if err := SetLogLevel(component, level); err != nil {
+				Http_respond_error(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if component == "" {
+				component = "default"
+			}
+			L.Warnf("Changed log level of %v to %v", component, level)
+		default:
+			Http_respond_error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		Http_respond_json(w, r, LogLevels())
+	})
+}
+
+// flag.Value changing the level of a logger
+type levelFlag struct {
+	logger *Logger
+}
+
+func (f levelFlag) String() string {
+	if f.logger == nil {
+		return ""
+	}
+	return strconv.Itoa(int(f.logger.EffectiveLevel()))
+}
+
+func (f levelFlag) Set(value string) error {
+	level, err := ParseLogLevel(value)
+	if err == nil {
+		f.logger.Enable(level)
+	}
+	return err
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
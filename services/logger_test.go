@@ -0,0 +1,118 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func captureLog(t *testing.T, format LogFormat) *bytes.Buffer {
+	var buf bytes.Buffer
+	SetLogFormat(format)
+	SetLogOutput(&buf)
+	t.Cleanup(func() {
+		SetLogFormat(FormatText)
+		SetLogOutput(os.Stdout)
+	})
+	return &buf
+}
+
+func TestLogFormats(t *testing.T) {
+	logger := NewLogger(LevelNormal).With(Fields{"order": 12, "user": "jo doe"})
+	logger.Component = "shop"
+
+	buf := captureLog(t, FormatJSON)
+	logger.Warnf("Order %v failed", 12)
+	var obj map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &obj); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", buf.String(), err)
+	}
+	if obj["level"] != "warn" || obj["msg"] != "Order 12 failed" || obj["component"] != "shop" ||
+		obj["order"] != float64(12) || obj["user"] != "jo doe" || obj["time"] == nil {
+		t.Errorf("Unexpected JSON log line: %v", obj)
+	}
+
+	buf = captureLog(t, FormatLogfmt)
+	logger.Logf("Order %v", "shipped")
+	line := buf.String()
+	if !strings.Contains(line, ` level=log msg="Order shipped" component=shop order=12 user="jo doe"`) {
+		t.Errorf("Unexpected logfmt log line: %q", line)
+	}
+
+	buf = captureLog(t, FormatText)
+	logger.Tracef("Not logged")
+	logger.Errorf("Out of stock")
+	if line := buf.String(); !strings.HasSuffix(line, "Error: Out of stock component=shop order=12 user=\"jo doe\"\n") ||
+		strings.Contains(line, "Not logged") {
+		t.Errorf("Unexpected text log line: %q", line)
+	}
+}
+
+func TestComponentLevels(t *testing.T) {
+	defer L.Enable(L.Level)
+	logger := Component("test-component")
+	defer logger.InheritLevel()
+
+	L.Enable(LevelWarn)
+	if logger.LevelEnabled(LevelNormal) || !logger.LevelEnabled(LevelWarn) {
+		t.Errorf("Component does not inherit level %v", L.EffectiveLevel())
+	}
+	if err := SetLogLevel("test-component", "trace"); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.LevelEnabled(LevelTrace) || L.LevelEnabled(LevelNormal) {
+		t.Errorf("Level of component not changed independently")
+	}
+	if levels := LogLevels(); levels["test-component"] != "Trace" || levels["default"] != "Warn" {
+		t.Errorf("Unexpected levels: %v", levels)
+	}
+	if err := SetLogLevel("test-component", "inherit"); err != nil {
+		t.Fatal(err)
+	}
+	if logger.EffectiveLevel() != LevelWarn || LogLevels()["test-component"] != "inherit" {
+		t.Errorf("Component does not inherit level again: %v", logger.EffectiveLevel())
+	}
+	if err := SetLogLevel("", "loud"); err == nil {
+		t.Errorf("Unknown level accepted")
+	}
+	if err := SetLogLevel("no-such-component", "trace"); err == nil {
+		t.Errorf("Unknown component accepted")
+	}
+	if _, ok := LogLevels()["no-such-component"]; ok {
+		t.Errorf("Unknown component created")
+	}
+}
+
+func TestHandleLogLevels(t *testing.T) {
+	defer L.Enable(L.Level)
+	logger := Component("test-handler")
+	defer logger.InheritLevel()
+	captureLog(t, FormatText)
+
+	form := url.Values{"component": {"test-handler"}, "level": {"Error"}}
+	req := httptest.NewRequest("POST", "/loglevel", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	HandleLogLevels().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || logger.EffectiveLevel() != LevelError {
+		t.Fatalf("Level not changed: %v %v", rec.Code, rec.Body.String())
+	}
+	var levels map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &levels); err != nil || levels["test-handler"] != "Error" {
+		t.Errorf("Unexpected response %q: %v", rec.Body.String(), err)
+	}
+
+	form.Set("level", "loud")
+	req = httptest.NewRequest("PUT", "/loglevel", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	HandleLogLevels().ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Unknown level not rejected: %v", rec.Code)
+	}
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Identifies a request in the access logs of all services it passes. Taken from incoming
+// requests or generated, and forwarded by the Client when making requests with the context.
+const RequestIDHeader = "X-Request-Id"
+
+const max_request_id_length = 128
+
+var access_logger = Component("access")
+
+// Wraps the handler of a server, see ChainHandler()
+type ServerMiddleware func(next http.Handler) http.Handler
+
+// The first middleware is the outermost, i.e. it sees the request first
+func ChainHandler(handler http.Handler, middleware ...ServerMiddleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+type requestIDKey struct{}
+
+// Return the ID attached to the context by RequestIDs(), or ""
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func newRequestID() string {
+	var id [12]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id[:])
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > max_request_id_length {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Attach the ID in the RequestIDHeader, or a new one, to the request context
+// and return it in the response header
+func RequestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// Log every request with its status, size and latency on the "access" component logger
+func LogAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := recordStatus(w)
+		next.ServeHTTP(recorder, r)
+		if access_logger.Enabled() {
+			fields := Fields{
+				"method":  r.Method,
+				"path":    r.URL.Path,
+				"status":  recorder.Status(),
+				"bytes":   recorder.written,
+				"latency": time.Since(start),
+				"remote":  r.RemoteAddr,
+			}
+			if id := RequestID(r.Context()); id != "" {
+				fields["request_id"] = id
+			}
+			access_logger.With(fields).Logf("%v %v", r.Method, r.URL)
+		}
+	})
+}
+
+// Answer requests with a JSON error and 500 Internal Server Error if the handler panics.
+// If the response was already started, it is cut off instead.
+func RecoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := recordStatus(w)
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			L.With(Fields{"request_id": RequestID(r.Context())}).Errorf(
+				"Panic serving %v %v: %v\n%s", r.Method, r.URL, err, debug.Stack())
+			if recorder.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			Http_respond_json_error(recorder, r, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// Answer requests with bodies larger than maxBytes with 413 Request Entity Too Large.
+// Bodies without a Content-Length fail to read after maxBytes.
+func LimitBody(maxBytes int64) ServerMiddleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				Http_respond_json_error(w, r, fmt.Sprintf("Request body larger than %v bytes", maxBytes),
+					http.StatusRequestEntityTooLarge)
+				return
+			}
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Records the status code and response size for the middleware. Nested
+// middleware share the statusRecorder of the outermost one.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func recordStatus(w http.ResponseWriter) *statusRecorder {
+	if recorder, ok := w.(*statusRecorder); ok {
+		return recorder
+	}
+	return &statusRecorder{ResponseWriter: w}
+}
+
+// The status of the response, 200 if the handler did not set one
+func (w *statusRecorder) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("%T does not support hijacking", w.ResponseWriter)
+}
@@ -45,8 +45,8 @@ func init() {
 	addr, err := golib.FirstIpAddress()
 	if err != nil {
 		endpoint_lock_value = uuid.New()
-		L.Warnf("Failed to determine IP address: %v", err)
-		L.Warnf("Using random value for redis locks: %v", endpoint_lock_value)
+		redis_logger.Warnf("Failed to determine IP address: %v", err)
+		redis_logger.Warnf("Using random value for redis locks: %v", endpoint_lock_value)
 	}
 	endpoint_lock_value = addr.String()
 }
@@ -115,7 +115,7 @@ func (lock *RedisLock) Transaction(transaction func(redis Redis) error) error {
 	if err != nil {
 		// Transaction failed, try to unlock
 		if unlockErr := lock.Unlock(); unlockErr != nil {
-			L.Logf("Lock-transaction failed and failed to unlock %v (%v): %v", lock.LockName, lock.LockValue, unlockErr)
+			redis_logger.Logf("Lock-transaction failed and failed to unlock %v (%v): %v", lock.LockName, lock.LockValue, unlockErr)
 		}
 	}
 	return err
@@ -133,7 +133,7 @@ func (lock *RedisLock) ExtendTransaction(transaction func(redis Redis) error) er
 	if err != nil {
 		// Transaction failed, try to unlock
 		if unlockErr := lock.Unlock(); unlockErr != nil {
-			L.Logf("Extend-Lock-transaction failed and failed to unlock %v (%v): %v", lock.LockName, lock.LockValue, unlockErr)
+			redis_logger.Logf("Extend-Lock-transaction failed and failed to unlock %v (%v): %v", lock.LockName, lock.LockValue, unlockErr)
 		}
 	}
 	return err
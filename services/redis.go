@@ -14,6 +14,7 @@ const (
 
 var (
 	nestedTransactionError = errors.New("Cannot nest redis transactions")
+	redis_logger           = Component("redis")
 )
 
 type Redis interface {
@@ -41,6 +42,13 @@ func ConnectRedis(endpoint string) (Redis, error) {
 	return &redis{client}, nil
 }
 
+// Readiness check for Health.AddCheck()
+func RedisCheck(redis Redis) func() error {
+	return func() error {
+		return redis.Cmd("ping").Err()
+	}
+}
+
 type redis struct {
 	client *pool.Pool
 }
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	default_max_body_size = 1 << 20
+
+	healthz_path  = "/healthz"
+	readyz_path   = "/readyz"
+	metrics_path  = "/metrics"
+	loglevel_path = "/loglevel"
+
+	// Metrics key for requests not matching any route of the router
+	unmatched_route = "unmatched"
+)
+
+// Counts requests per route of a mux.Router, identified by the path template
+// (e.g. "/account/{id}") and method. The route matched by the router is recorded by
+// a middleware of the router, which Middleware() adds to it.
+type RouteMetrics struct {
+	Router *mux.Router
+
+	lock    sync.Mutex
+	routes  map[string]*routeCounters
+	useOnce sync.Once
+}
+
+type routeCounters struct {
+	requests     uint
+	inFlight     int
+	serverErrors uint
+	clientErrors uint
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+type RouteStats struct {
+	Requests     uint
+	InFlight     int
+	ServerErrors uint // Status 5xx
+	ClientErrors uint // Status 4xx
+	AvgLatency   string
+	MaxLatency   string
+}
+
+type matchedRouteKey struct{}
+
+// Filled in by RouteMetrics.routeMatched() when the router found a route
+type matchedRoute struct {
+	name string
+}
+
+// Runs inside the router after it matched the request, so the route is not matched twice
+func (metrics *RouteMetrics) routeMatched(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if matched, ok := r.Context().Value(matchedRouteKey{}).(*matchedRoute); ok {
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					matched.name = r.Method + " " + template
+					metrics.lock.Lock()
+					metrics.counters(matched.name).inFlight++
+					metrics.lock.Unlock()
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (metrics *RouteMetrics) counters(route string) *routeCounters {
+	if metrics.routes == nil {
+		metrics.routes = make(map[string]*routeCounters)
+	}
+	counters := metrics.routes[route]
+	if counters == nil {
+		counters = new(routeCounters)
+		metrics.routes[route] = counters
+	}
+	return counters
+}
+
+func (metrics *RouteMetrics) Middleware(next http.Handler) http.Handler {
+	if metrics.Router != nil {
+		metrics.useOnce.Do(func() {
+			metrics.Router.Use(metrics.routeMatched)
+		})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matched := new(matchedRoute)
+		start := time.Now()
+		recorder := recordStatus(w)
+		defer func() {
+			latency := time.Since(start)
+			status := recorder.Status()
+			metrics.lock.Lock()
+			defer metrics.lock.Unlock()
+			var counters *routeCounters
+			if matched.name == "" {
+				counters = metrics.counters(unmatched_route)
+			} else {
+				counters = metrics.counters(matched.name)
+				counters.inFlight--
+			}
+			counters.requests++
+			counters.totalLatency += latency
+			if latency > counters.maxLatency {
+				counters.maxLatency = latency
+			}
+			switch {
+			case status >= 500:
+				counters.serverErrors++
+			case status >= 400:
+				counters.clientErrors++
+			}
+		}()
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), matchedRouteKey{}, matched)))
+	})
+}
+
+func (metrics *RouteMetrics) Stats() map[string]RouteStats {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	result := make(map[string]RouteStats, len(metrics.routes))
+	for route, counters := range metrics.routes {
+		stats := RouteStats{
+			Requests:     counters.requests,
+			InFlight:     counters.inFlight,
+			ServerErrors: counters.serverErrors,
+			ClientErrors: counters.clientErrors,
+			MaxLatency:   counters.maxLatency.String(),
+		}
+		if counters.requests > 0 {
+			stats.AvgLatency = (counters.totalLatency / time.Duration(counters.requests)).String()
+		}
+		result[route] = stats
+	}
+	return result
+}
+
+func (metrics *RouteMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	Http_respond_json(w, r, metrics.Stats())
+}
+
+// Serves the liveness and readiness endpoints of a service. The service is live as
+// long as it answers requests, and ready while all checks succeed.
+type Health struct {
+	lock   sync.Mutex
+	checks map[string]func() error
+}
+
+// Add a readiness check, e.g. pinging a database. Checks run on every readiness request.
+func (health *Health) AddCheck(name string, check func() error) {
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	if health.checks == nil {
+		health.checks = make(map[string]func() error)
+	}
+	health.checks[name] = check
+}
+
+// Run all checks and return their results, "ok" for successful checks
+func (health *Health) Check() (map[string]string, bool) {
+	health.lock.Lock()
+	checks := make(map[string]func() error, len(health.checks))
+	for name, check := range health.checks {
+		checks[name] = check
+	}
+	health.lock.Unlock()
+
+	result := make(map[string]string, len(checks))
+	ready := true
+	for name, check := range checks {
+		if err := check(); err != nil {
+			L.Warnf("Readiness check %v failed: %v", name, err)
+			result[name] = err.Error()
+			ready = false
+		} else {
+			result[name] = "ok"
+		}
+	}
+	return result, ready
+}
+
+func (health *Health) Live() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Http_respond_json(w, r, map[string]string{"status": "ok"})
+	})
+}
+
+// Responds with 503 Service Unavailable if any check fails
+func (health *Health) Ready() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks, ready := health.Check()
+		if ready {
+			Http_respond_json(w, r, map[string]interface{}{"status": "ok", "checks": checks})
+		} else {
+			Http_respond_json_status(w, r, map[string]interface{}{"status": "unavailable", "checks": checks},
+				http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// The standard handler chain of the services around their router: request IDs, access
+// logging, a limit for request bodies, per-route metrics, panic recovery and deadline
+// propagation. NewServer() registers the endpoints /healthz, /readyz and /metrics on
+// the router, ServeLogLevels() adds /loglevel.
+type Server struct {
+	Router  *mux.Router
+	Health  *Health
+	Metrics *RouteMetrics
+
+	// default_max_body_size if zero, unlimited if negative
+	MaxBodySize int64
+
+	// Additional middleware applied around the router, inside the standard chain
+	Middleware []ServerMiddleware
+}
+
+func NewServer(router *mux.Router) *Server {
+	server := &Server{
+		Router:  router,
+		Health:  new(Health),
+		Metrics: &RouteMetrics{Router: router},
+	}
+	router.Handle(healthz_path, server.Health.Live()).Methods("GET")
+	router.Handle(readyz_path, server.Health.Ready()).Methods("GET")
+	router.Handle(metrics_path, server.Metrics).Methods("GET")
+	return server
+}
+
+// Let clients change the log levels on /loglevel, see HandleLogLevels(). The endpoint
+// is not authenticated, so only enable it if the service is not publicly reachable.
+func (server *Server) ServeLogLevels() {
+	server.Router.Handle(loglevel_path, HandleLogLevels())
+}
+
+func (server *Server) Use(middleware ...ServerMiddleware) {
+	server.Middleware = append(server.Middleware, middleware...)
+}
+
+func (server *Server) Handler() http.Handler {
+	chain := []ServerMiddleware{RequestIDs, LogAccess}
+	if maxBody := server.MaxBodySize; maxBody >= 0 {
+		if maxBody == 0 {
+			maxBody = default_max_body_size
+		}
+		// Before the router, which can parse the form while matching a route
+		chain = append(chain, LimitBody(maxBody))
+	}
+	if server.Metrics != nil {
+		chain = append(chain, server.Metrics.Middleware)
+	}
+	chain = append(chain, RecoverPanics)
+	chain = append(chain, PropagateDeadline)
+	chain = append(chain, server.Middleware...)
+	return ChainHandler(server.Router, chain...)
+}
+
+func (server *Server) ListenAndServe(addr string) error {
+	L.Warnf("Running on %v", addr)
+	return http.ListenAndServe(addr, server.Handler())
+}
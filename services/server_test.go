@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func testServer(t *testing.T) (*Server, *httptest.Server) {
+	captureLog(t, FormatText)
+	router := mux.NewRouter()
+	server := NewServer(router)
+	server.MaxBodySize = 16
+	router.HandleFunc("/item/{name}", func(w http.ResponseWriter, r *http.Request) {
+		Http_respond_json(w, r, map[string]string{"request": RequestID(r.Context())})
+	}).Methods("GET")
+	router.HandleFunc("/item/{name}", func(w http.ResponseWriter, r *http.Request) {
+		Http_respond(w, r, []byte(r.FormValue("value")), http.StatusOK)
+	}).Methods("POST")
+	router.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("broken handler")
+	})
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+func TestServerRequestIDs(t *testing.T) {
+	_, httpServer := testServer(t)
+	req, _ := http.NewRequest("GET", httpServer.URL+"/item/a", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil || result["request"] != "abc-123" || resp.Header.Get(RequestIDHeader) != "abc-123" {
+		t.Errorf("Request ID not propagated: %v %v %v", result, resp.Header, err)
+	}
+
+	resp, err = http.Get(httpServer.URL + "/item/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get(RequestIDHeader); len(id) != 24 {
+		t.Errorf("No request ID generated: %q", id)
+	}
+
+	var forwarded map[string]string
+	ctx := WithRequestID(context.Background(), "from-client")
+	if err := new(Client).GetJson(ctx, httpServer.URL+"/item/a", &forwarded); err != nil || forwarded["request"] != "from-client" {
+		t.Errorf("Request ID not forwarded by the client: %v %v", forwarded, err)
+	}
+}
+
+func TestServerRecoversPanics(t *testing.T) {
+	_, httpServer := testServer(t)
+	resp, err := http.Get(httpServer.URL + "/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != http.StatusInternalServerError ||
+		result["error"] != "Internal server error" {
+		t.Errorf("Unexpected response to panic: %v %v %v", resp.Status, result, err)
+	}
+}
+
+func TestServerLimitsBody(t *testing.T) {
+	_, httpServer := testServer(t)
+	resp, err := http.Post(httpServer.URL+"/item/a", "application/x-www-form-urlencoded", strings.NewReader("value=12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Small body rejected: %v", resp.Status)
+	}
+	resp, err = http.Post(httpServer.URL+"/item/a", "application/x-www-form-urlencoded",
+		strings.NewReader("value=12345678901234567890"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Large body not rejected: %v", resp.Status)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	server, httpServer := testServer(t)
+	for _, path := range []string{"/item/a", "/item/b", "/panic", "/missing"} {
+		resp, err := http.Get(httpServer.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	stats := server.Metrics.Stats()
+	if item := stats["GET /item/{name}"]; item.Requests != 2 || item.ServerErrors != 0 || item.InFlight != 0 {
+		t.Errorf("Unexpected metrics of item route: %+v", item)
+	}
+	if broken := stats["GET /panic"]; broken.Requests != 1 || broken.ServerErrors != 1 {
+		t.Errorf("Unexpected metrics of panicking route: %+v", broken)
+	}
+	if missing := stats[unmatched_route]; missing.Requests != 1 || missing.ClientErrors != 1 {
+		t.Errorf("Unexpected metrics of unmatched requests: %+v", missing)
+	}
+}
+
+func TestServerMetricsMatchRouteOnce(t *testing.T) {
+	server, httpServer := testServer(t)
+	matches := 0
+	server.Router.Path("/counted").MatcherFunc(func(r *http.Request, match *mux.RouteMatch) bool {
+		matches++
+		return true
+	}).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	resp, err := http.Get(httpServer.URL + "/counted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if matches != 1 || server.Metrics.Stats()["GET /counted"].Requests != 1 {
+		t.Errorf("Route matched %v times: %v", matches, server.Metrics.Stats())
+	}
+}
+
+func TestServerLogLevelsOptIn(t *testing.T) {
+	server, httpServer := testServer(t)
+	get := func() int {
+		resp, err := http.Get(httpServer.URL + loglevel_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(); code != http.StatusNotFound {
+		t.Errorf("Log levels served without ServeLogLevels(): %v", code)
+	}
+	server.ServeLogLevels()
+	if code := get(); code != http.StatusOK {
+		t.Errorf("Log levels not served: %v", code)
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	server, httpServer := testServer(t)
+	var failure error
+	server.Health.AddCheck("database", func() error { return failure })
+
+	get := func(path string) (int, map[string]interface{}) {
+		resp, err := http.Get(httpServer.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, result
+	}
+	if code, result := get(readyz_path); code != http.StatusOK || result["status"] != "ok" {
+		t.Errorf("Not ready: %v %v", code, result)
+	}
+	failure = errors.New("connection refused")
+	if code, result := get(readyz_path); code != http.StatusServiceUnavailable ||
+		result["checks"].(map[string]interface{})["database"] != "connection refused" {
+		t.Errorf("Ready despite failing check: %v %v", code, result)
+	}
+	if code, result := get(healthz_path); code != http.StatusOK || result["status"] != "ok" {
+		t.Errorf("Not live: %v %v", code, result)
+	}
+}
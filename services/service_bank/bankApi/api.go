@@ -1,6 +1,7 @@
 package bankApi
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strconv"
@@ -8,6 +9,13 @@ import (
 	"github.com/antongulenko/http-isolation-proxy/services"
 )
 
+// Sends all requests to the bank service, can be replaced or configured to change timeouts, retries etc.
+var Client = services.DefaultClient
+
+// Opt-in: fail fast while an operation of the bank service keeps failing, see services.CircuitBreaker.
+// The operations are named after the methods of Bank and Transaction.
+var Breaker *services.CircuitBreaker
+
 const (
 	TransactionPending      = "pending"
 	TransactionCommitted    = "committed"
@@ -26,14 +34,15 @@ type HttpAccount struct {
 }
 
 type Bank interface {
-	Balance(account string) (float64, error)
-	PendingDeposit(account string, value float64) (Transaction, error)
-	Deposit(account string, value float64) (Transaction, error)
-	PendingTransfer(from, to string, value float64) (Transaction, error)
-	Transfer(from, to string, value float64) (Transaction, error)
-	GetTransaction(id string) (Transaction, error)
+	Balance(ctx context.Context, account string) (float64, error)
+	PendingDeposit(ctx context.Context, account string, value float64) (Transaction, error)
+	Deposit(ctx context.Context, account string, value float64) (Transaction, error)
+	PendingTransfer(ctx context.Context, from, to string, value float64) (Transaction, error)
+	Transfer(ctx context.Context, from, to string, value float64) (Transaction, error)
+	GetTransaction(ctx context.Context, id string) (Transaction, error)
 }
 
+// Uses the context of the Bank call that returned it
 type Transaction interface {
 	// Fetch remote information
 	Update() error
@@ -58,6 +67,7 @@ type HttpTransaction struct {
 	state string
 	error string
 	bank  *HttpBank
+	ctx   context.Context
 }
 
 func NewHttpBank(endpoint string) Bank {
@@ -66,67 +76,79 @@ func NewHttpBank(endpoint string) Bank {
 	}
 }
 
-func (bank *HttpBank) Balance(account string) (float64, error) {
+func (bank *HttpBank) Balance(ctx context.Context, account string) (float64, error) {
 	the_url := "http://" + bank.endpoint + "/account/" + account
 	var result HttpAccount
-	err := services.Http_get_json(the_url, &result)
+	err := Breaker.Call(ctx, "Balance", func() error {
+		return Client.GetJson(ctx, the_url, &result)
+	})
 	if err != nil {
 		return 0, err
 	}
 	return result.Balance, nil
 }
 
-func (bank *HttpBank) checkTransactionResponse(data string, err error, url string) (Transaction, error) {
+func (bank *HttpBank) checkTransactionResponse(ctx context.Context, data string, err error, url string) (Transaction, error) {
 	if err != nil {
 		return nil, err
 	}
 	return &HttpTransaction{
 		id:   (string)(data),
 		bank: bank,
+		ctx:  ctx,
 	}, nil
 }
 
-func (bank *HttpBank) PendingTransfer(from, to string, value float64) (Transaction, error) {
-	return bank.transfer(from, to, value, false)
+func (bank *HttpBank) PendingTransfer(ctx context.Context, from, to string, value float64) (Transaction, error) {
+	return bank.transfer(ctx, "PendingTransfer", from, to, value, false)
 }
 
-func (bank *HttpBank) Transfer(from, to string, value float64) (Transaction, error) {
-	return bank.transfer(from, to, value, true)
+func (bank *HttpBank) Transfer(ctx context.Context, from, to string, value float64) (Transaction, error) {
+	return bank.transfer(ctx, "Transfer", from, to, value, true)
 }
 
-func (bank *HttpBank) transfer(from, to string, value float64, auto_commit bool) (Transaction, error) {
+func (bank *HttpBank) transfer(ctx context.Context, operation string, from, to string, value float64, auto_commit bool) (Transaction, error) {
 	the_url := "http://" + bank.endpoint + "/account/" + from + "/transfer"
-	resp, err := services.Http_post_string(the_url,
-		url.Values{
-			"target": []string{to},
-			"value":  []string{fmt.Sprintf("%v", value)},
-			"commit": []string{strconv.FormatBool(auto_commit)},
-		})
-	return bank.checkTransactionResponse(resp, err, the_url)
+	var resp string
+	err := Breaker.Call(ctx, operation, func() (err error) {
+		resp, err = Client.PostString(ctx, the_url,
+			url.Values{
+				"target": []string{to},
+				"value":  []string{fmt.Sprintf("%v", value)},
+				"commit": []string{strconv.FormatBool(auto_commit)},
+			})
+		return
+	})
+	return bank.checkTransactionResponse(ctx, resp, err, the_url)
 }
 
-func (bank *HttpBank) Deposit(account string, value float64) (Transaction, error) {
-	return bank.deposit(account, value, true)
+func (bank *HttpBank) Deposit(ctx context.Context, account string, value float64) (Transaction, error) {
+	return bank.deposit(ctx, "Deposit", account, value, true)
 }
 
-func (bank *HttpBank) PendingDeposit(account string, value float64) (Transaction, error) {
-	return bank.deposit(account, value, false)
+func (bank *HttpBank) PendingDeposit(ctx context.Context, account string, value float64) (Transaction, error) {
+	return bank.deposit(ctx, "PendingDeposit", account, value, false)
 }
 
-func (bank *HttpBank) deposit(account string, value float64, auto_commit bool) (Transaction, error) {
+func (bank *HttpBank) deposit(ctx context.Context, operation string, account string, value float64, auto_commit bool) (Transaction, error) {
 	the_url := "http://" + bank.endpoint + "/account/" + account + "/deposit"
-	resp, err := services.Http_post_string(the_url,
-		url.Values{
-			"value":  []string{fmt.Sprintf("%v", value)},
-			"commit": []string{strconv.FormatBool(auto_commit)},
-		})
-	return bank.checkTransactionResponse(resp, err, the_url)
-}
-
-func (bank *HttpBank) GetTransaction(id string) (Transaction, error) {
+	var resp string
+	err := Breaker.Call(ctx, operation, func() (err error) {
+		resp, err = Client.PostString(ctx, the_url,
+			url.Values{
+				"value":  []string{fmt.Sprintf("%v", value)},
+				"commit": []string{strconv.FormatBool(auto_commit)},
+			})
+		return
+	})
+	return bank.checkTransactionResponse(ctx, resp, err, the_url)
+}
+
+func (bank *HttpBank) GetTransaction(ctx context.Context, id string) (Transaction, error) {
 	tran := &HttpTransaction{
 		id:   id,
 		bank: bank,
+		ctx:  ctx,
 	}
 	if err := tran.Update(); err != nil {
 		return nil, err
@@ -137,7 +159,11 @@ func (bank *HttpBank) GetTransaction(id string) (Transaction, error) {
 
 func (trans *HttpTransaction) Update() error {
 	the_url := "http://" + trans.bank.endpoint + "/transaction/" + trans.id
-	data, err := services.Http_get_json_map(the_url, "state", "error")
+	var data map[string]interface{}
+	err := Breaker.Call(trans.ctx, "Update", func() (err error) {
+		data, err = Client.GetJsonMap(trans.ctx, the_url, "state", "error")
+		return
+	})
 	if err != nil {
 		return err
 	}
@@ -151,25 +177,27 @@ func (trans *HttpTransaction) Update() error {
 	return nil
 }
 
-func (trans *HttpTransaction) performAction(action string) error {
+func (trans *HttpTransaction) performAction(operation string, action string) error {
 	the_url := "http://" + trans.bank.endpoint + "/transaction/" + trans.id + "/" + action
-	err := services.Http_simple_post(the_url)
-	if err != nil {
+	err := Breaker.Call(trans.ctx, operation, func() error {
+		return Client.Post(trans.ctx, the_url)
+	})
+	if _, open := services.CircuitOpen(err); err != nil && !open {
 		return fmt.Errorf("Failed to %s transaction: %v", action, err)
 	}
-	return nil
+	return err
 }
 
 func (trans *HttpTransaction) Commit() error {
-	return trans.performAction("commit")
+	return trans.performAction("Commit", "commit")
 }
 
 func (trans *HttpTransaction) Cancel() error {
-	return trans.performAction("cancel")
+	return trans.performAction("Cancel", "cancel")
 }
 
 func (trans *HttpTransaction) Revert() error {
-	return trans.performAction("revert")
+	return trans.performAction("Revert", "revert")
 }
 
 func (trans *HttpTransaction) State() string {
@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"log"
-	"net/http"
 
 	"github.com/antongulenko/golib"
 	"github.com/antongulenko/http-isolation-proxy/services"
@@ -14,12 +13,12 @@ func main() {
 	golib.ConfiguredOpenFilesLimit = 40000
 	addr := flag.String("listen", "0.0.0.0:9001", "Endpoint address")
 	flag.Parse()
-	services.EnableResponseLogging()
 	golib.ConfigureOpenFilesLimit()
 
 	store := NewAccountStore(1000, 200)
 
 	mux := mux.NewRouter()
+	server := services.NewServer(mux)
 	mux.HandleFunc("/stats", store.show_stats).Methods("GET")
 	mux.HandleFunc("/account/{id}", store.show_account).Methods("GET")
 	mux.HandleFunc("/account/{id}/deposit", store.handle_deposit).Methods("POST").MatcherFunc(services.MatchFormKeys("value"))
@@ -29,8 +28,7 @@ func main() {
 	mux.HandleFunc("/transaction/{id}/revert", store.revert_transaction).Methods("POST")
 	mux.HandleFunc("/transaction/{id}/commit", store.commit_transaction).Methods("POST")
 
-	services.L.Warnf("Running on " + *addr)
-	if err := http.ListenAndServe(*addr, mux); err != nil {
+	if err := server.ListenAndServe(*addr); err != nil {
 		log.Fatal(err)
 	}
 }
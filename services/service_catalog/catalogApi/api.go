@@ -1,12 +1,20 @@
 package catalogApi
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 
 	"github.com/antongulenko/http-isolation-proxy/services"
 )
 
+// Sends all requests to the catalog service, can be replaced or configured to change timeouts, retries etc.
+var Client = services.DefaultClient
+
+// Opt-in: fail fast while an operation of the catalog service keeps failing, see services.CircuitBreaker.
+// The operations are named after the functions of this package.
+var Breaker *services.CircuitBreaker
+
 type Item struct {
 	Name     string  `json:"name" redis:"-"`
 	Stock    uint64  `json:"stock"`
@@ -40,38 +48,55 @@ func (shipment *Shipment) String() string {
 	return fmt.Sprintf("Shipment (%v) %vx %v -> %v", shipment.Status, shipment.Quantity, shipment.Item, shipment.User)
 }
 
-func AllItems(endpoint string) ([]*Item, error) {
+func AllItems(ctx context.Context, endpoint string) ([]*Item, error) {
 	var result []*Item
-	return result, services.Http_get_json("http://"+endpoint+"/items", &result)
+	return result, Breaker.Call(ctx, "AllItems", func() error {
+		return Client.GetJson(ctx, "http://"+endpoint+"/items", &result)
+	})
 }
 
-func GetItem(endpoint string, item string) (*Item, error) {
+func GetItem(ctx context.Context, endpoint string, item string) (*Item, error) {
 	var result Item
-	return &result, services.Http_get_json("http://"+endpoint+"/item/"+item, &result)
+	return &result, Breaker.Call(ctx, "GetItem", func() error {
+		return Client.GetJson(ctx, "http://"+endpoint+"/item/"+item, &result)
+	})
 }
 
-func ShipItem(endpoint string, item string, user string, quantity uint64, timestamp string) (string, error) {
-	return services.Http_post_string("http://"+endpoint+"/item/"+item+"/ship",
-		url.Values{
-			"user": []string{user},
-			"qty":  []string{fmt.Sprintf("%v", quantity)},
-			"ts":   []string{timestamp},
-		})
+func ShipItem(ctx context.Context, endpoint string, item string, user string, quantity uint64, timestamp string) (string, error) {
+	var id string
+	err := Breaker.Call(ctx, "ShipItem", func() (err error) {
+		id, err = Client.PostString(ctx, "http://"+endpoint+"/item/"+item+"/ship",
+			url.Values{
+				"user": []string{user},
+				"qty":  []string{fmt.Sprintf("%v", quantity)},
+				"ts":   []string{timestamp},
+			})
+		return
+	})
+	return id, err
 }
 
-func GetShipment(endpoint string, id string) (*Shipment, error) {
+func GetShipment(ctx context.Context, endpoint string, id string) (*Shipment, error) {
 	var result Shipment
-	return &result, services.Http_get_json("http://"+endpoint+"/shipment/"+id, &result)
+	return &result, Breaker.Call(ctx, "GetShipment", func() error {
+		return Client.GetJson(ctx, "http://"+endpoint+"/shipment/"+id, &result)
+	})
 }
 
-func CommitShipment(endpoint string, id string) error {
-	return services.Http_simple_post("http://" + endpoint + "/shipment/" + id + "/commit")
+func CommitShipment(ctx context.Context, endpoint string, id string) error {
+	return Breaker.Call(ctx, "CommitShipment", func() error {
+		return Client.Post(ctx, "http://"+endpoint+"/shipment/"+id+"/commit")
+	})
 }
 
-func CancelShipment(endpoint string, id string) error {
-	return services.Http_simple_post("http://" + endpoint + "/shipment/" + id + "/cancel")
+func CancelShipment(ctx context.Context, endpoint string, id string) error {
+	return Breaker.Call(ctx, "CancelShipment", func() error {
+		return Client.Post(ctx, "http://"+endpoint+"/shipment/"+id+"/cancel")
+	})
 }
 
-func DeliverShipment(endpoint string, id string) error {
-	return services.Http_simple_post("http://" + endpoint + "/shipment/" + id + "/deliver")
+func DeliverShipment(ctx context.Context, endpoint string, id string) error {
+	return Breaker.Call(ctx, "DeliverShipment", func() error {
+		return Client.Post(ctx, "http://"+endpoint+"/shipment/"+id+"/deliver")
+	})
 }
@@ -3,10 +3,10 @@ package main
 import (
 	"flag"
 	"log"
-	"net/http"
 	"time"
 
 	"github.com/antongulenko/golib"
+	"github.com/antongulenko/http-isolation-proxy/proxy"
 	"github.com/antongulenko/http-isolation-proxy/services"
 	"github.com/gorilla/mux"
 )
@@ -28,10 +28,9 @@ func fillDefaultCatalog(catalog *Catalog) error {
 func main() {
 	addr := flag.String("listen", "0.0.0.0:9003", "Endpoint address")
 	redisEndpoint := flag.String("redis", "127.0.0.1:6379", "Redis endpoint")
-	services.ParseBalanceEndpointsFlags()
+	proxy.ParseBalancerFlags()
 	flag.Parse()
-	services.ParseLoadBalanceConfig()
-	services.EnableResponseLogging()
+	proxy.EnableClientBalancing()
 	golib.ConfigureOpenFilesLimit()
 
 	redisClient, err := services.ConnectRedis(*redisEndpoint)
@@ -59,6 +58,7 @@ func main() {
 	})
 
 	mux := mux.NewRouter()
+	server := services.NewServer(mux)
 	mux.HandleFunc("/items", catalog.show_items).Methods("GET")
 	mux.HandleFunc("/item/{name}", catalog.show_item).Methods("GET")
 	mux.HandleFunc("/item/{name}/ship", catalog.ship_item).Methods("POST").MatcherFunc(services.MatchFormKeys("user", "qty", "ts"))
@@ -66,8 +66,9 @@ func main() {
 	mux.HandleFunc("/shipment/{id}/commit", catalog.commit_shipment).Methods("POST")
 	mux.HandleFunc("/shipment/{id}/cancel", catalog.cancel_shipment).Methods("POST")
 	mux.HandleFunc("/shipment/{id}/deliver", catalog.deliver_shipment).Methods("POST")
-	services.L.Warnf("Running on " + *addr)
-	if err := http.ListenAndServe(*addr, mux); err != nil {
+
+	server.Health.AddCheck("redis", services.RedisCheck(redisClient))
+	if err := server.ListenAndServe(*addr); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -72,7 +72,7 @@ func (item *Item) Ship(user string, qty uint64, timestamp string) (*Shipment, bo
 
 func (shipment *Shipment) unlock() {
 	if err := shipment.lock.Unlock(); err != nil {
-		services.L.Warnf("Error releasing redis lock for shipment:", err)
+		services.L.Warnf("Error releasing redis lock for shipment: %v", err)
 	}
 }
 
@@ -16,7 +16,7 @@ func (payments *Payments) new_payment(w http.ResponseWriter, r *http.Request) {
 	}
 	username := r.FormValue("user")
 	timestamp := r.FormValue("ts")
-	payment, existed, err := payments.NewPayment(username, value, timestamp)
+	payment, existed, err := payments.NewPayment(r.Context(), username, value, timestamp)
 	if err != nil {
 		services.Http_respond_error(w, r, "Error creating payment: "+err.Error(), http.StatusInternalServerError)
 	} else {
@@ -32,7 +32,7 @@ func (payments *Payments) new_payment(w http.ResponseWriter, r *http.Request) {
 
 func (payments *Payments) get_payment(w http.ResponseWriter, r *http.Request, lockPayment bool) *Payment {
 	id := mux.Vars(r)["id"]
-	payment := payments.MakePayment(id)
+	payment := payments.MakePayment(r.Context(), id)
 	existed, err := payment.LoadExisting(lockPayment, true)
 	if err != nil {
 		services.Http_respond_error(w, r, "Error fetching payment "+id+": "+err.Error(), http.StatusInternalServerError)
@@ -3,9 +3,9 @@ package main
 import (
 	"flag"
 	"log"
-	"net/http"
 
 	"github.com/antongulenko/golib"
+	"github.com/antongulenko/http-isolation-proxy/proxy"
 	"github.com/antongulenko/http-isolation-proxy/services"
 	"github.com/antongulenko/http-isolation-proxy/services/service_bank/bankApi"
 	"github.com/gorilla/mux"
@@ -15,11 +15,14 @@ func main() {
 	addr := flag.String("listen", "0.0.0.0:9002", "Endpoint address")
 	redisEndpoint := flag.String("redis", "127.0.0.1:6379", "Redis endpoint")
 	bankEndpoint := flag.String("bank", "localhost:9001", "Endpoint for bank service")
-	services.ParseBalanceEndpointsFlags()
+	circuitBreaker := flag.Bool("circuitBreaker", false, "Fail fast while calls to the bank service keep failing")
+	proxy.ParseBalancerFlags()
 	flag.Parse()
-	services.ParseLoadBalanceConfig()
-	services.EnableResponseLogging()
+	proxy.EnableClientBalancing()
 	golib.ConfigureOpenFilesLimit()
+	if *circuitBreaker {
+		bankApi.Breaker = new(services.CircuitBreaker)
+	}
 
 	bank := bankApi.NewHttpBank(*bankEndpoint)
 	redisClient, err := services.ConnectRedis(*redisEndpoint)
@@ -38,13 +41,14 @@ func main() {
 		redisLockValue: services.EndpointLockValue(*addr),
 	}
 	mux := mux.NewRouter()
+	server := services.NewServer(mux)
 	mux.HandleFunc("/payment", payments.new_payment).Methods("POST").MatcherFunc(services.MatchFormKeys("user", "value", "ts"))
 	mux.HandleFunc("/payment/{id}", payments.show_payment).Methods("GET")
 	mux.HandleFunc("/payment/{id}/commit", payments.commit_payment).Methods("POST")
 	mux.HandleFunc("/payment/{id}/cancel", payments.cancel_payment).Methods("POST")
 
-	services.L.Warnf("Running on " + *addr)
-	if err := http.ListenAndServe(*addr, mux); err != nil {
+	server.Health.AddCheck("redis", services.RedisCheck(redisClient))
+	if err := server.ListenAndServe(*addr); err != nil {
 		log.Fatal(err)
 	}
 }
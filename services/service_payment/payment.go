@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -58,6 +59,7 @@ type Payment struct {
 	TransactionId string `json:"-" redis:"tid"`
 	id            string
 	status        PaymentStatus
+	ctx           context.Context // Used for all calls to the bank
 }
 
 func (payment *Payment) Key() string {
@@ -68,9 +70,10 @@ func (payment *Payment) Client() services.Redis {
 	return payment.payments.redis
 }
 
-func (payments *Payments) MakePayment(id string) *Payment {
+func (payments *Payments) MakePayment(ctx context.Context, id string) *Payment {
 	payment := &Payment{
 		id:       id,
+		ctx:      ctx,
 		payments: payments,
 		lock: services.RedisLock{
 			Client:     payments.redis,
@@ -83,12 +86,12 @@ func (payments *Payments) MakePayment(id string) *Payment {
 	return payment
 }
 
-func (payments *Payments) NewPayment(username string, value float64, timestamp string) (*Payment, bool, error) {
+func (payments *Payments) NewPayment(ctx context.Context, username string, value float64, timestamp string) (*Payment, bool, error) {
 	// Create a reproducible ID based on input data (hence the timestamp)
 	hash := services.MakeHash(username, value, timestamp)
 
 	// Try to fetch an existing payment
-	payment := payments.MakePayment(hash)
+	payment := payments.MakePayment(ctx, hash)
 	existed, err := payment.LoadExisting(true, false)
 	if err != nil {
 		return nil, false, err
@@ -147,7 +150,7 @@ func (payment *Payment) LoadExisting(lockPayment bool, unlock_missing_payment bo
 
 func (payment *Payment) unlock() {
 	if err := payment.lock.Unlock(); err != nil {
-		services.L.Warnf("Error releasing redis lock for payment:", err)
+		services.L.Warnf("Error releasing redis lock for payment: %v", err)
 	}
 }
 
@@ -240,7 +243,7 @@ func (payment *Payment) advance(targetState PaymentStatus) error {
 }
 
 func (payment *Payment) advanceToPending() error {
-	trans, err := payment.payments.bank.PendingTransfer(payment.User, payment.payments.accountName, payment.Value)
+	trans, err := payment.payments.bank.PendingTransfer(payment.ctx, payment.User, payment.payments.accountName, payment.Value)
 	if err != nil {
 		// Should probably retry here
 		return fmt.Errorf("Failed to create pending transaction: %v", err)
@@ -269,7 +272,7 @@ func (payment *Payment) getTransaction() (bankApi.Transaction, error) {
 	if payment.TransactionId == "" {
 		return nil, fmt.Errorf("Payment (%s) has no transaction Id...", payment.status)
 	}
-	trans, err := payment.payments.bank.GetTransaction(payment.TransactionId)
+	trans, err := payment.payments.bank.GetTransaction(payment.ctx, payment.TransactionId)
 	if err != nil {
 		return nil, fmt.Errorf("Error getting transaction of %v payment: %v", payment.status, err)
 	}
@@ -1,12 +1,20 @@
 package paymentApi
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 
 	"github.com/antongulenko/http-isolation-proxy/services"
 )
 
+// Sends all requests to the payment service, can be replaced or configured to change timeouts, retries etc.
+var Client = services.DefaultClient
+
+// Opt-in: fail fast while an operation of the payment service keeps failing, see services.CircuitBreaker.
+// The operations are named after the functions of this package.
+var Breaker *services.CircuitBreaker
+
 const (
 	PaymentCreated   = "created"
 	PaymentPending   = "pending"
@@ -31,24 +39,35 @@ func (p *Payment) String() string {
 	return fmt.Sprintf("Payment (%v) %v from %v", p.Status, p.Value, p.User, errStr)
 }
 
-func CreatePayment(endpoint string, user string, value float64, timestamp string) (string, error) {
-	return services.Http_post_string("http://"+endpoint+"/payment",
-		url.Values{
-			"user":  []string{user},
-			"value": []string{fmt.Sprintf("%v", value)},
-			"ts":    []string{timestamp},
-		})
+func CreatePayment(ctx context.Context, endpoint string, user string, value float64, timestamp string) (string, error) {
+	var id string
+	err := Breaker.Call(ctx, "CreatePayment", func() (err error) {
+		id, err = Client.PostString(ctx, "http://"+endpoint+"/payment",
+			url.Values{
+				"user":  []string{user},
+				"value": []string{fmt.Sprintf("%v", value)},
+				"ts":    []string{timestamp},
+			})
+		return
+	})
+	return id, err
 }
 
-func FetchPayment(endpoint string, id string) (*Payment, error) {
+func FetchPayment(ctx context.Context, endpoint string, id string) (*Payment, error) {
 	var result Payment
-	return &result, services.Http_get_json("http://"+endpoint+"/payment/"+id, &result)
+	return &result, Breaker.Call(ctx, "FetchPayment", func() error {
+		return Client.GetJson(ctx, "http://"+endpoint+"/payment/"+id, &result)
+	})
 }
 
-func CommitPayment(endpoint string, id string) error {
-	return services.Http_simple_post("http://" + endpoint + "/payment/" + id + "/commit")
+func CommitPayment(ctx context.Context, endpoint string, id string) error {
+	return Breaker.Call(ctx, "CommitPayment", func() error {
+		return Client.Post(ctx, "http://"+endpoint+"/payment/"+id+"/commit")
+	})
 }
 
-func CancelPayment(endpoint string, id string) error {
-	return services.Http_simple_post("http://" + endpoint + "/payment/" + id + "/cancel")
+func CancelPayment(ctx context.Context, endpoint string, id string) error {
+	return Breaker.Call(ctx, "CancelPayment", func() error {
+		return Client.Post(ctx, "http://"+endpoint+"/payment/"+id+"/cancel")
+	})
 }
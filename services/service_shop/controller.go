@@ -9,7 +9,7 @@ import (
 )
 
 func (shop *Shop) show_items(w http.ResponseWriter, r *http.Request) {
-	if items, err := shop.AllItems(); items != nil {
+	if items, err := shop.AllItems(r.Context()); items != nil {
 		// TODO instead of parsing and encoding the JSON reply, simply forward it
 		services.Http_respond_json(w, r, items)
 	} else {
@@ -3,10 +3,13 @@ package main
 import (
 	"flag"
 	"log"
-	"net/http"
+	"time"
 
 	"github.com/antongulenko/golib"
+	"github.com/antongulenko/http-isolation-proxy/proxy"
 	"github.com/antongulenko/http-isolation-proxy/services"
+	"github.com/antongulenko/http-isolation-proxy/services/service_catalog/catalogApi"
+	"github.com/antongulenko/http-isolation-proxy/services/service_payment/paymentApi"
 	"github.com/gorilla/mux"
 )
 
@@ -28,11 +31,15 @@ func main() {
 	redisEndpoint := flag.String("redis", "127.0.0.1:6379", "Redis endpoint")
 	paymentEndpoint := flag.String("payment", "localhost:9002", "Endpoint for payment service")
 	catalogEndpoint := flag.String("catalog", "localhost:9003", "Endpoint for catalog service")
-	services.ParseBalanceEndpointsFlags()
+	circuitBreaker := flag.Bool("circuitBreaker", false, "Fail fast while calls to the catalog or payment service keep failing")
+	proxy.ParseBalancerFlags()
 	flag.Parse()
-	services.ParseLoadBalanceConfig()
-	services.EnableResponseLogging()
+	proxy.EnableClientBalancing()
 	golib.ConfigureOpenFilesLimit()
+	if *circuitBreaker {
+		catalogApi.Breaker = new(services.CircuitBreaker)
+		paymentApi.Breaker = new(services.CircuitBreaker)
+	}
 
 	redisClient, err := services.ConnectRedis(*redisEndpoint)
 	if err != nil {
@@ -48,17 +55,19 @@ func main() {
 		redisLockValue:  services.EndpointLockValue(*addr),
 		catalogEndpoint: *catalogEndpoint,
 		paymentEndpoint: *paymentEndpoint,
+		backoff:         make(map[string]time.Time),
 	}
 	launchOrderProcessing(shop)
 
 	mux := mux.NewRouter()
+	server := services.NewServer(mux)
 	mux.HandleFunc("/shop", shop.show_items).Methods("GET")
 	mux.HandleFunc("/order", shop.order_item).Methods("POST").MatcherFunc(services.MatchFormKeys("user", "item", "qty"))
 	mux.HandleFunc("/order/{order}", shop.get_order).Methods("GET")
 	mux.HandleFunc("/orders/{user}", shop.show_orders).Methods("GET")
 
-	services.L.Warnf("Running on " + *addr)
-	if err := http.ListenAndServe(*addr, mux); err != nil {
+	server.Health.AddCheck("redis", services.RedisCheck(redisClient))
+	if err := server.ListenAndServe(*addr); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -53,6 +54,9 @@ func (shop *Shop) processOrder(order_id string) {
 		LockValue:  shop.redisLockValue,
 		Expiration: order_processing_expiration,
 	}
+	if shop.backingOff(order_id) {
+		return
+	}
 	order := shop.MakeOrder(order_id)
 
 	if err := lock.TryLock(); err != nil {
@@ -74,7 +78,12 @@ func (shop *Shop) processOrder(order_id string) {
 		services.L.Warnf("Locked order %v does not exist", order_id)
 	}
 
-	item, err := catalogApi.GetItem(shop.catalogEndpoint, order.Item)
+	// Don't wait for remote calls that cannot finish before the lock expires
+	ctx, cancel := context.WithTimeout(context.Background(), order_processing_expiration)
+	defer cancel()
+	order.ctx = ctx
+
+	item, err := catalogApi.GetItem(order.ctx, shop.catalogEndpoint, order.Item)
 	if err != nil {
 		services.L.Warnf("Failed to retrieve item '%s' for order processing: %v", order.Item, err)
 	}
@@ -93,8 +102,9 @@ func (shop *Shop) doProcessOrder(order *Order, item *catalogApi.Item) {
 
 func (order *Order) assertShipment(item *catalogApi.Item) bool {
 	if order.ShipmentId == "" {
-		id, err := catalogApi.ShipItem(order.shop.catalogEndpoint, order.Item, order.User, order.Quantity, order.Timestamp)
+		id, err := catalogApi.ShipItem(order.ctx, order.shop.catalogEndpoint, order.Item, order.User, order.Quantity, order.Timestamp)
 		if err != nil {
+			order.backOff(err)
 			services.L.Logf("Failed to create item shipment: %v", err)
 			return false
 		}
@@ -110,8 +120,9 @@ func (order *Order) assertShipment(item *catalogApi.Item) bool {
 func (order *Order) assertPayment(item *catalogApi.Item) bool {
 	if order.PaymentId == "" {
 		totalCost := float64(order.Quantity) * item.Cost
-		id, err := paymentApi.CreatePayment(order.shop.paymentEndpoint, order.User, totalCost, order.Timestamp)
+		id, err := paymentApi.CreatePayment(order.ctx, order.shop.paymentEndpoint, order.User, totalCost, order.Timestamp)
 		if err != nil {
+			order.backOff(err)
 			services.L.Logf("Failed to create payment: %v", err)
 			return false
 		}
@@ -125,7 +136,7 @@ func (order *Order) assertPayment(item *catalogApi.Item) bool {
 }
 
 func (order *Order) shipmentStatus() catalogApi.ShipmentStatus {
-	shipment, err := catalogApi.GetShipment(order.shop.catalogEndpoint, order.ShipmentId)
+	shipment, err := catalogApi.GetShipment(order.ctx, order.shop.catalogEndpoint, order.ShipmentId)
 	if order.checkError(err) {
 		return ""
 	}
@@ -149,7 +160,7 @@ func (order *Order) commitShipment() bool {
 	}
 	switch shipmentStatus {
 	case catalogApi.ShipmentCreated:
-		err := catalogApi.CommitShipment(order.shop.catalogEndpoint, order.ShipmentId)
+		err := catalogApi.CommitShipment(order.ctx, order.shop.catalogEndpoint, order.ShipmentId)
 		if order.checkError(err) {
 			return false
 		}
@@ -163,13 +174,13 @@ func (order *Order) commitShipment() bool {
 }
 
 func (order *Order) commitPayment() bool {
-	payment, err := paymentApi.FetchPayment(order.shop.paymentEndpoint, order.PaymentId)
+	payment, err := paymentApi.FetchPayment(order.ctx, order.shop.paymentEndpoint, order.PaymentId)
 	if order.checkError(err) {
 		return false
 	}
 	switch payment.Status {
 	case paymentApi.PaymentCreated, paymentApi.PaymentPending:
-		err := paymentApi.CommitPayment(order.shop.paymentEndpoint, order.PaymentId)
+		err := paymentApi.CommitPayment(order.ctx, order.shop.paymentEndpoint, order.PaymentId)
 		_ = order.checkError(err)
 		// TODO maybe check that state changed to committed?
 		return false
@@ -185,7 +196,7 @@ func (order *Order) commitPayment() bool {
 }
 
 func (order *Order) deliverShipment() bool {
-	err := catalogApi.DeliverShipment(order.shop.catalogEndpoint, order.ShipmentId)
+	err := catalogApi.DeliverShipment(order.ctx, order.shop.catalogEndpoint, order.ShipmentId)
 	if order.checkError(err) {
 		return false
 	}
@@ -201,6 +212,7 @@ func isConflictError(err error) bool {
 
 // Return true, if we should retry later.
 // In case of a CONFLICT 408 status, cancel the order.
+// If a circuit breaker failed the call, do not retry before the circuit might close again.
 func (order *Order) checkError(err error) bool {
 	if err == nil {
 		return false
@@ -209,10 +221,31 @@ func (order *Order) checkError(err error) bool {
 		order.Cancel(err)
 		return true
 	}
+	order.backOff(err)
 	services.L.Logf("Error processing order %v: %v", order.id, err)
 	return true
 }
 
+func (order *Order) backOff(err error) {
+	if retryAfter, open := services.CircuitOpen(err); open {
+		order.shop.backoffLock.Lock()
+		defer order.shop.backoffLock.Unlock()
+		order.shop.backoff[order.id] = retryAfter
+	}
+}
+
+func (shop *Shop) backingOff(order_id string) bool {
+	shop.backoffLock.Lock()
+	defer shop.backoffLock.Unlock()
+	if retryAfter, ok := shop.backoff[order_id]; ok {
+		if time.Now().Before(retryAfter) {
+			return true
+		}
+		delete(shop.backoff, order_id)
+	}
+	return false
+}
+
 func (order *Order) Finalize() {
 	services.L.Logf("Finalizing order %v", order.id)
 	logStr := "Order processed successfully"
@@ -234,12 +267,12 @@ func (order *Order) doCancel(success bool, log string) error {
 	cancelLog := log
 
 	// Try to cancel the shipment, if necessary
-	shipment, err := catalogApi.GetShipment(order.shop.catalogEndpoint, order.ShipmentId)
+	shipment, err := catalogApi.GetShipment(order.ctx, order.shop.catalogEndpoint, order.ShipmentId)
 	if err != nil {
 		return err
 	}
 	if !success && shipment.Status != catalogApi.ShipmentCancelled {
-		err := catalogApi.CancelShipment(order.shop.catalogEndpoint, order.ShipmentId)
+		err := catalogApi.CancelShipment(order.ctx, order.shop.catalogEndpoint, order.ShipmentId)
 		if err != nil {
 			if isConflictError(err) {
 				cancelLog += fmt.Sprintf("\nError cancelling shipment: %v", err)
@@ -254,12 +287,12 @@ func (order *Order) doCancel(success bool, log string) error {
 	}
 
 	// Try to cancel the payment, if necessary
-	payment, err := paymentApi.FetchPayment(order.shop.paymentEndpoint, order.PaymentId)
+	payment, err := paymentApi.FetchPayment(order.ctx, order.shop.paymentEndpoint, order.PaymentId)
 	if err != nil {
 		return err
 	}
 	if !success && payment.Status != paymentApi.PaymentFailed {
-		err := paymentApi.CancelPayment(order.shop.paymentEndpoint, order.PaymentId)
+		err := paymentApi.CancelPayment(order.ctx, order.shop.paymentEndpoint, order.PaymentId)
 		if err != nil {
 			if isConflictError(err) {
 				cancelLog += fmt.Sprintf("\nError cancelling payment: %v", err)
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pborman/uuid"
@@ -26,6 +28,10 @@ type Shop struct {
 	redisLockValue  string
 	catalogEndpoint string
 	paymentEndpoint string
+
+	// Orders are not processed before the given time, see Order.checkError
+	backoffLock sync.Mutex
+	backoff     map[string]time.Time
 }
 
 type Item catalogApi.Item
@@ -40,6 +46,7 @@ type Order struct {
 
 	id   string
 	shop *Shop
+	ctx  context.Context // Used for all calls to other services
 }
 
 func (order *Order) Key() string {
@@ -50,8 +57,8 @@ func (order *Order) Client() services.Redis {
 	return order.shop.redis
 }
 
-func (shop *Shop) AllItems() ([]*Item, error) {
-	items, err := catalogApi.AllItems(shop.catalogEndpoint)
+func (shop *Shop) AllItems(ctx context.Context) ([]*Item, error) {
+	items, err := catalogApi.AllItems(ctx, shop.catalogEndpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -66,6 +73,7 @@ func (shop *Shop) MakeOrder(id string) *Order {
 	order := &Order{
 		shop: shop,
 		id:   id,
+		ctx:  context.Background(),
 	}
 	order.StoredObject = services.StoredObject{order}
 	return order
@@ -1,6 +1,7 @@
 package shopApi
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 
@@ -8,6 +9,9 @@ import (
 	"github.com/antongulenko/http-isolation-proxy/services/service_catalog/catalogApi"
 )
 
+// Sends all requests to the shop service, can be replaced or configured to change timeouts, retries etc.
+var Client = services.DefaultClient
+
 type Item catalogApi.Item
 
 const (
@@ -26,18 +30,18 @@ func (order *Order) IsProcessing() bool {
 	return order.Status == OrderStatusProcessing
 }
 
-func AllItems(shopEndpoint string) ([]*Item, error) {
+func AllItems(ctx context.Context, shopEndpoint string) ([]*Item, error) {
 	var result []*Item
-	return result, services.Http_get_json("http://"+shopEndpoint+"/shop", &result)
+	return result, Client.GetJson(ctx, "http://"+shopEndpoint+"/shop", &result)
 }
 
-func AllOrders(shopEndpoint string, user string) ([]*Order, error) {
+func AllOrders(ctx context.Context, shopEndpoint string, user string) ([]*Order, error) {
 	var result []*Order
-	return result, services.Http_get_json("http://"+shopEndpoint+"/orders/"+user, &result)
+	return result, Client.GetJson(ctx, "http://"+shopEndpoint+"/orders/"+user, &result)
 }
 
-func PlaceOrder(shopEndpoint string, user string, item string, quantity int64) (string, error) {
-	return services.Http_post_string("http://"+shopEndpoint+"/order",
+func PlaceOrder(ctx context.Context, shopEndpoint string, user string, item string, quantity int64) (string, error) {
+	return Client.PostString(ctx, "http://"+shopEndpoint+"/order",
 		url.Values{
 			"user": []string{user},
 			"item": []string{item},
@@ -45,7 +49,7 @@ func PlaceOrder(shopEndpoint string, user string, item string, quantity int64) (
 		})
 }
 
-func GetOrder(shopEndpoint string, orderId string) (*Order, error) {
+func GetOrder(ctx context.Context, shopEndpoint string, orderId string) (*Order, error) {
 	var result *Order
-	return result, services.Http_get_json("http://"+shopEndpoint+"/order/"+orderId, &result)
+	return result, Client.GetJson(ctx, "http://"+shopEndpoint+"/order/"+orderId, &result)
 }
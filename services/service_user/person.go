@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"sync"
@@ -132,7 +133,7 @@ func (person *Person) error(err error) bool {
 }
 
 func (person *Person) earn() {
-	_, err := person.bank.Deposit(person.Name, person.monthlyPay)
+	_, err := person.bank.Deposit(context.Background(), person.Name, person.monthlyPay)
 	person.BankRequests++
 	services.L.Logf("%v earning %v", person.Name, person.monthlyPay)
 	person.error(err)
@@ -150,7 +151,7 @@ func (person *Person) shop() {
 
 	// First check on the status of open orders.
 	for orderId, _ := range person.openOrders {
-		order, err := shopApi.GetOrder(shopEndpoint, orderId)
+		order, err := shopApi.GetOrder(context.Background(), shopEndpoint, orderId)
 		person.ShopRequests++
 		if person.error(err) {
 			return
@@ -168,7 +169,7 @@ func (person *Person) shop() {
 		return
 	}
 
-	items, err := shopApi.AllItems(shopEndpoint)
+	items, err := shopApi.AllItems(context.Background(), shopEndpoint)
 	person.ShopRequests++
 	if person.error(err) {
 		return
@@ -176,7 +177,7 @@ func (person *Person) shop() {
 	item_index := rand.Uint32() % uint32(len(items))
 	item := items[item_index].Name
 	services.L.Logf("%v ordering %v", person.Name, item)
-	id, err := shopApi.PlaceOrder(shopEndpoint, person.Name, item, 1)
+	id, err := shopApi.PlaceOrder(context.Background(), shopEndpoint, person.Name, item, 1)
 	person.ShopRequests++
 	if person.error(err) {
 		return
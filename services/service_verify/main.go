@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -49,7 +50,7 @@ func main() {
 	bank := bankApi.NewHttpBank(*bankEndpoint)
 	inconsistent := false
 
-	allItems, err := shopApi.AllItems(shopEndpoint)
+	allItems, err := shopApi.AllItems(context.Background(), shopEndpoint)
 	itemMap := make(map[string]*shopApi.Item)
 	var totalEarned float64
 	var totalShipped uint64
@@ -80,7 +81,7 @@ func main() {
 	var totalProcessingOrders uint64
 	for i := uint64(0); i < *num_users; i++ {
 		user := fmt.Sprintf("User%v", i)
-		orders, err := shopApi.AllOrders(shopEndpoint, user)
+		orders, err := shopApi.AllOrders(context.Background(), shopEndpoint, user)
 		check(err)
 
 		if *verbose {
@@ -114,7 +115,7 @@ func main() {
 		inconsistent = true
 	}
 
-	balance, err := bank.Balance("store")
+	balance, err := bank.Balance(context.Background(), "store")
 	check(err)
 
 	balance = round(balance)